@@ -0,0 +1,309 @@
+package exthttp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen is returned by circuit breaker RoundTripper when request was rejected without being sent.
+var ErrCircuitOpen = errCircuitOpen{}
+
+type errCircuitOpen struct{}
+
+func (errCircuitOpen) Error() string { return "circuit breaker is open" }
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+var breakerStates = []breakerState{stateClosed, stateOpen, stateHalfOpen}
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerOption sets the value of an option for circuit breaker Tripperware.
+type CircuitBreakerOption func(*circuitBreakerOptions)
+
+type circuitBreakerOptions struct {
+	consecutiveFailures int
+	failureRatio        float64
+	minRequests         int
+	window              time.Duration
+	openDuration        time.Duration
+	halfOpenProbes      int
+	isFailure           func(*http.Response, error) bool
+}
+
+// WithBreakerConsecutiveFailures opens the circuit after n consecutive failures. Zero disables this condition. Default is 5.
+func WithBreakerConsecutiveFailures(n int) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.consecutiveFailures = n
+	}
+}
+
+// WithBreakerFailureRatio opens the circuit when the ratio of failed requests within the window reaches the given
+// ratio, as long as there were at least minRequests in that window. Zero ratio disables this condition.
+// Default is 0.5 ratio with 20 minimum requests within 10s window.
+func WithBreakerFailureRatio(ratio float64, minRequests int, window time.Duration) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.failureRatio = ratio
+		o.minRequests = minRequests
+		o.window = window
+	}
+}
+
+// WithBreakerOpenDuration sets for how long the circuit stays open before it lets probes in. Default is 10s.
+func WithBreakerOpenDuration(d time.Duration) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.openDuration = d
+	}
+}
+
+// WithBreakerHalfOpenProbes sets how many requests are let through in half-open state. If all of them succeed,
+// the circuit closes, otherwise it opens again. Default is 3.
+func WithBreakerHalfOpenProbes(n int) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.halfOpenProbes = n
+	}
+}
+
+// WithBreakerFailure sets function deciding if the round trip failed. By default errors other than canceled requests
+// and 5xx responses are failures.
+func WithBreakerFailure(f func(*http.Response, error) bool) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.isFailure = f
+	}
+}
+
+func defaultBreakerFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		// Caller gave up on the request, which says nothing about the target.
+		return ClassifyError(err) != ReasonCanceled
+	}
+	return resp.StatusCode >= 500
+}
+
+type circuitBreakerTripperware struct {
+	reg  prometheus.Registerer
+	opts circuitBreakerOptions
+}
+
+// NewCircuitBreakerTripperware provides Tripperware that stops sending requests to the target that keeps failing.
+// Each wrapped target has its own circuit breaker. Rejected requests fail with ErrCircuitOpen. State transitions
+// are exposed as metrics and recorded as events on the request span. It returns error if options would leave
+// the circuit stuck open or closed.
+func NewCircuitBreakerTripperware(reg prometheus.Registerer, opts ...CircuitBreakerOption) (Tripperware, error) {
+	o := circuitBreakerOptions{
+		consecutiveFailures: 5,
+		failureRatio:        0.5,
+		minRequests:         20,
+		window:              10 * time.Second,
+		openDuration:        10 * time.Second,
+		halfOpenProbes:      3,
+		isFailure:           defaultBreakerFailure,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.consecutiveFailures < 0 {
+		return nil, errors.Errorf("consecutive failures can't be negative, got %v", o.consecutiveFailures)
+	}
+	if o.failureRatio < 0 || o.failureRatio > 1 {
+		return nil, errors.Errorf("failure ratio has to be within [0, 1], got %v", o.failureRatio)
+	}
+	if o.consecutiveFailures == 0 && o.failureRatio == 0 {
+		return nil, errors.New("both consecutive failures and failure ratio are disabled, circuit would never open")
+	}
+	if o.failureRatio > 0 && o.minRequests < 1 {
+		return nil, errors.Errorf("minimum requests has to be positive, got %v", o.minRequests)
+	}
+	if o.window < 0 {
+		return nil, errors.Errorf("failure ratio window can't be negative, got %v", o.window)
+	}
+	if o.openDuration < 0 {
+		return nil, errors.Errorf("open duration can't be negative, got %v", o.openDuration)
+	}
+	if o.halfOpenProbes < 1 {
+		return nil, errors.Errorf("half-open probes have to be positive, got %v", o.halfOpenProbes)
+	}
+	return &circuitBreakerTripperware{reg: reg, opts: o}, nil
+}
+
+func (c *circuitBreakerTripperware) WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": targetName}, c.reg)
+	b := &circuitBreaker{
+		opts: c.opts,
+		state: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_client_circuit_breaker_state",
+				Help: "Tracks the state of the circuit breaker. The current state has value 1.",
+			}, []string{"state"},
+		),
+		transitions: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_client_circuit_breaker_transitions_total",
+				Help: "Tracks the number of circuit breaker state transitions.",
+			}, []string{"from", "to"},
+		),
+		rejected: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "http_client_circuit_breaker_rejected_requests_total",
+				Help: "Tracks the number of HTTP requests rejected by the open circuit breaker.",
+			},
+		),
+		windowStart: time.Now(),
+	}
+	b.setStateGauge()
+
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		span := trace.SpanFromContext(req.Context())
+
+		gen, ok := b.allow(span)
+		if !ok {
+			b.rejected.Inc()
+			span.AddEvent("circuit breaker rejected request", trace.WithAttributes(attribute.String("state", b.currentState().String())))
+			return nil, ErrCircuitOpen
+		}
+
+		resp, err := next.RoundTrip(req)
+		b.record(span, gen, c.opts.isFailure(resp, err))
+		return resp, err
+	})
+}
+
+type circuitBreaker struct {
+	opts circuitBreakerOptions
+
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+	rejected    prometheus.Counter
+
+	mu sync.Mutex
+	// generation is bumped on every transition, so results of requests allowed in previous state are ignored.
+	generation     uint64
+	current        breakerState
+	openedAt       time.Time
+	consecutive    int
+	windowStart    time.Time
+	windowRequests int
+	windowFailures int
+	probes         int
+	probeSuccesses int
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
+func (b *circuitBreaker) allow(span trace.Span) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.current {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.opts.openDuration {
+			return 0, false
+		}
+		b.transition(span, stateHalfOpen)
+		fallthrough
+	case stateHalfOpen:
+		if b.probes >= b.opts.halfOpenProbes {
+			return 0, false
+		}
+		b.probes++
+	}
+	return b.generation, true
+}
+
+func (b *circuitBreaker) record(span trace.Span, gen uint64, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if gen != b.generation {
+		return
+	}
+
+	switch b.current {
+	case stateHalfOpen:
+		if failed {
+			b.transition(span, stateOpen)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.opts.halfOpenProbes {
+			b.transition(span, stateClosed)
+		}
+	case stateClosed:
+		if b.opts.window > 0 && time.Since(b.windowStart) > b.opts.window {
+			b.windowStart, b.windowRequests, b.windowFailures = time.Now(), 0, 0
+		}
+		b.windowRequests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.consecutive++
+		b.windowFailures++
+
+		if b.opts.consecutiveFailures > 0 && b.consecutive >= b.opts.consecutiveFailures {
+			b.transition(span, stateOpen)
+			return
+		}
+		if b.opts.failureRatio > 0 && b.windowRequests >= b.opts.minRequests &&
+			float64(b.windowFailures)/float64(b.windowRequests) >= b.opts.failureRatio {
+			b.transition(span, stateOpen)
+		}
+	}
+}
+
+// transition has to be called under lock.
+func (b *circuitBreaker) transition(span trace.Span, to breakerState) {
+	from := b.current
+	b.current = to
+	b.generation++
+	b.consecutive, b.probes, b.probeSuccesses = 0, 0, 0
+	b.windowStart, b.windowRequests, b.windowFailures = time.Now(), 0, 0
+	if to == stateOpen {
+		b.openedAt = time.Now()
+	}
+
+	b.transitions.WithLabelValues(from.String(), to.String()).Inc()
+	b.setStateGauge()
+	span.AddEvent("circuit breaker state changed", trace.WithAttributes(
+		attribute.String("from", from.String()),
+		attribute.String("to", to.String()),
+	))
+}
+
+func (b *circuitBreaker) setStateGauge() {
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == b.current {
+			v = 1
+		}
+		b.state.WithLabelValues(s.String()).Set(v)
+	}
+}
@@ -0,0 +1,246 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// exportedBreakerState returns the current state exported by circuit breaker metrics.
+func exportedBreakerState(t *testing.T, reg *prometheus.Registry) string {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "http_client_circuit_breaker_state" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge().GetValue() != 1 {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "state" {
+					return l.GetValue()
+				}
+			}
+		}
+	}
+	t.Fatal("no current state exported")
+	return ""
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const openDuration = 50 * time.Millisecond
+
+	var (
+		reg    = prometheus.NewRegistry()
+		status = http.StatusOK
+		sent   int
+	)
+	breaker, err := NewCircuitBreakerTripperware(reg,
+		WithBreakerConsecutiveFailures(3),
+		WithBreakerFailureRatio(0, 0, 0),
+		WithBreakerOpenDuration(openDuration),
+		WithBreakerHalfOpenProbes(2),
+	)
+	testutil.Ok(t, err)
+	rt := breaker.WrapRoundTripper("app", promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: status}, nil
+	}))
+	ping := func() error {
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+		return err
+	}
+
+	testutil.Equals(t, "closed", exportedBreakerState(t, reg))
+
+	// Success resets consecutive failures.
+	status = http.StatusInternalServerError
+	testutil.Ok(t, ping())
+	testutil.Ok(t, ping())
+	status = http.StatusOK
+	testutil.Ok(t, ping())
+	status = http.StatusInternalServerError
+	testutil.Ok(t, ping())
+	testutil.Ok(t, ping())
+	testutil.Equals(t, "closed", exportedBreakerState(t, reg))
+
+	// Third consecutive failure opens the circuit, requests are rejected without being sent.
+	testutil.Ok(t, ping())
+	testutil.Equals(t, "open", exportedBreakerState(t, reg))
+	sentBefore := sent
+	testutil.Equals(t, ErrCircuitOpen, ping())
+	testutil.Equals(t, sentBefore, sent)
+
+	// After open duration probes are let through, failed probe opens the circuit again.
+	time.Sleep(openDuration)
+	testutil.Ok(t, ping())
+	testutil.Equals(t, "open", exportedBreakerState(t, reg))
+	testutil.Equals(t, ErrCircuitOpen, ping())
+
+	// All probes have to succeed to close the circuit.
+	time.Sleep(openDuration)
+	status = http.StatusOK
+	testutil.Ok(t, ping())
+	testutil.Equals(t, "half-open", exportedBreakerState(t, reg))
+	testutil.Ok(t, ping())
+	testutil.Equals(t, "closed", exportedBreakerState(t, reg))
+	testutil.Ok(t, ping())
+}
+
+func TestCircuitBreaker_HalfOpenProbesLimit(t *testing.T) {
+	const openDuration = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	breaker, err := NewCircuitBreakerTripperware(prometheus.NewRegistry(),
+		WithBreakerConsecutiveFailures(1),
+		WithBreakerOpenDuration(openDuration),
+		WithBreakerHalfOpenProbes(1),
+	)
+	testutil.Ok(t, err)
+	rt := breaker.WrapRoundTripper("app", promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/fail" {
+			return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+		}
+		<-release
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/fail", nil))
+	testutil.Ok(t, err)
+	time.Sleep(openDuration)
+
+	probeDone := make(chan error)
+	go func() {
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+		probeDone <- err
+	}()
+	// Wait until the probe is in flight.
+	time.Sleep(10 * time.Millisecond)
+
+	// Only one probe is allowed in half-open state.
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/fail", nil))
+	testutil.Equals(t, ErrCircuitOpen, err)
+
+	close(release)
+	testutil.Ok(t, <-probeDone)
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+	testutil.Ok(t, err)
+}
+
+func TestCircuitBreaker_ResultsOfPreviousGenerationAreIgnored(t *testing.T) {
+	const openDuration = 20 * time.Millisecond
+
+	var (
+		reg     = prometheus.NewRegistry()
+		release = make(chan struct{})
+	)
+	breaker, err := NewCircuitBreakerTripperware(reg,
+		WithBreakerConsecutiveFailures(1),
+		WithBreakerOpenDuration(openDuration),
+		WithBreakerHalfOpenProbes(1),
+	)
+	testutil.Ok(t, err)
+	rt := breaker.WrapRoundTripper("app", promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/fail":
+			return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+		case "/slow-fail":
+			<-release
+			return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	roundTrip := func(path string) error {
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app"+path, nil))
+		return err
+	}
+
+	// Slow request is allowed while closed.
+	slowDone := make(chan error)
+	go func() { slowDone <- roundTrip("/slow-fail") }()
+	time.Sleep(10 * time.Millisecond)
+
+	// Circuit opens and goes half-open, but the probe is not done yet.
+	testutil.Ok(t, roundTrip("/fail"))
+	testutil.Equals(t, "open", exportedBreakerState(t, reg))
+	time.Sleep(openDuration)
+
+	probeRelease := make(chan struct{})
+	probeDone := make(chan error)
+	rtProbe := func() {
+		<-probeRelease
+		probeDone <- roundTrip("/ping")
+	}
+	go rtProbe()
+
+	// Failure of the request allowed while closed must not affect the new state.
+	close(release)
+	testutil.Ok(t, <-slowDone)
+	testutil.Equals(t, "open", exportedBreakerState(t, reg))
+
+	close(probeRelease)
+	testutil.Ok(t, <-probeDone)
+	testutil.Equals(t, "closed", exportedBreakerState(t, reg))
+}
+
+func TestCircuitBreaker_CanceledRequestsAreNotFailures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	breaker, err := NewCircuitBreakerTripperware(reg, WithBreakerConsecutiveFailures(1))
+	testutil.Ok(t, err)
+	rt := breaker.WrapRoundTripper("app", promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil).WithContext(ctx))
+	testutil.Equals(t, context.Canceled, err)
+	testutil.Equals(t, "closed", exportedBreakerState(t, reg))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil).WithContext(ctx))
+	testutil.Equals(t, context.DeadlineExceeded, err)
+	testutil.Equals(t, "open", exportedBreakerState(t, reg))
+}
+
+func TestNewCircuitBreakerTripperware_Validation(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		opts []CircuitBreakerOption
+
+		expErr bool
+	}{
+		{name: "defaults"},
+		{name: "only consecutive failures", opts: []CircuitBreakerOption{WithBreakerFailureRatio(0, 0, 0)}},
+		{name: "only failure ratio", opts: []CircuitBreakerOption{WithBreakerConsecutiveFailures(0)}},
+		{name: "negative consecutive failures", opts: []CircuitBreakerOption{WithBreakerConsecutiveFailures(-1)}, expErr: true},
+		{name: "failure ratio above 1", opts: []CircuitBreakerOption{WithBreakerFailureRatio(1.5, 20, time.Second)}, expErr: true},
+		{name: "negative failure ratio", opts: []CircuitBreakerOption{WithBreakerFailureRatio(-0.5, 20, time.Second)}, expErr: true},
+		{name: "both conditions disabled", opts: []CircuitBreakerOption{WithBreakerConsecutiveFailures(0), WithBreakerFailureRatio(0, 0, 0)}, expErr: true},
+		{name: "no minimum requests", opts: []CircuitBreakerOption{WithBreakerFailureRatio(0.5, 0, time.Second)}, expErr: true},
+		{name: "negative window", opts: []CircuitBreakerOption{WithBreakerFailureRatio(0.5, 20, -time.Second)}, expErr: true},
+		{name: "negative open duration", opts: []CircuitBreakerOption{WithBreakerOpenDuration(-time.Second)}, expErr: true},
+		{name: "no half-open probes", opts: []CircuitBreakerOption{WithBreakerHalfOpenProbes(0)}, expErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := NewCircuitBreakerTripperware(prometheus.NewRegistry(), tcase.opts...)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package exthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// CodeError is the value of the "code" label used for round trips that failed without an HTTP response.
+// Invalid responses keep their status code, see CodeAndReason.
+const CodeError = "error"
+
+// Reasons of failed round trips. Those are the only values used for "reason" label, so cardinality stays bounded.
+const (
+	ReasonTimeout  = "timeout"
+	ReasonRefused  = "refused"
+	ReasonReset    = "reset"
+	ReasonDNS      = "dns"
+	ReasonTLS      = "tls"
+	ReasonCanceled = "canceled"
+	// ReasonCircuitOpen means request was rejected by circuit breaker and never sent.
+	ReasonCircuitOpen = "circuit_open"
+	// ReasonInjected means connection error was injected by fault injection RoundTripper.
+	ReasonInjected = "injected"
+	// ReasonInvalidResponse means response was received, but failed validation.
+	ReasonInvalidResponse = "invalid_response"
+	ReasonOther           = "other"
+)
+
+// CodeAndReason returns values of "code" and "reason" labels for the result of the round trip. Failed round trips
+// have CodeError code, except invalid responses, which were received, so they keep their status code.
+func CodeAndReason(resp *http.Response, err error) (code, reason string) {
+	if err == nil {
+		return strconv.Itoa(resp.StatusCode), ""
+	}
+
+	var invalidErr *InvalidResponseError
+	if errors.As(err, &invalidErr) {
+		return strconv.Itoa(invalidErr.StatusCode), ReasonInvalidResponse
+	}
+	return CodeError, ClassifyError(err)
+}
+
+// ClassifyError returns bounded reason of the given round trip error. It returns empty string for nil error.
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		return ReasonCircuitOpen
+	}
+	if errors.Is(err, ErrInvalidResponse) {
+		return ReasonInvalidResponse
+	}
+	if errors.Is(err, ErrInjectedFault) {
+		return ReasonInjected
+	}
+	if errors.Is(err, context.Canceled) {
+		return ReasonCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ReasonTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ReasonDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ReasonRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ReasonReset
+	}
+
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		certErr      x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certErr) {
+		return ReasonTLS
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ReasonTimeout
+	}
+	return ReasonOther
+}
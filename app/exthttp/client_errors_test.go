@@ -0,0 +1,91 @@
+package exthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+// urlErr wraps error the same way http.Client does.
+func urlErr(err error) error {
+	return &url.Error{Op: "Get", URL: "http://app:8080/ping", Err: err}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		err  error
+		exp  string
+	}{
+		{name: "nil", err: nil, exp: ""},
+		{
+			name: "connection refused",
+			err:  urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}),
+			exp:  ReasonRefused,
+		},
+		{
+			name: "connection reset",
+			err:  urlErr(&net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}),
+			exp:  ReasonReset,
+		},
+		{
+			name: "DNS",
+			err:  urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "app", IsNotFound: true}}),
+			exp:  ReasonDNS,
+		},
+		{name: "deadline exceeded", err: urlErr(context.DeadlineExceeded), exp: ReasonTimeout},
+		{name: "net timeout", err: urlErr(&net.OpError{Op: "read", Net: "tcp", Err: timeoutErr{}}), exp: ReasonTimeout},
+		{name: "canceled", err: urlErr(context.Canceled), exp: ReasonCanceled},
+		{name: "x509 unknown authority", err: urlErr(x509.UnknownAuthorityError{}), exp: ReasonTLS},
+		{name: "x509 hostname", err: urlErr(x509.HostnameError{Host: "app"}), exp: ReasonTLS},
+		{name: "x509 invalid certificate", err: urlErr(x509.CertificateInvalidError{Reason: x509.Expired}), exp: ReasonTLS},
+		{name: "TLS record header", err: urlErr(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), exp: ReasonTLS},
+		{name: "circuit open", err: urlErr(ErrCircuitOpen), exp: ReasonCircuitOpen},
+		{name: "injected fault", err: urlErr(errors.Wrap(ErrInjectedFault, "round trip")), exp: ReasonInjected},
+		{name: "invalid response", err: urlErr(&InvalidResponseError{StatusCode: 200, Err: errors.New("body does not match")}), exp: ReasonInvalidResponse},
+		{name: "unknown", err: urlErr(errors.New("something went wrong")), exp: ReasonOther},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.exp, ClassifyError(tcase.err))
+		})
+	}
+}
+
+func TestCodeAndReason(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		resp *http.Response
+		err  error
+
+		expCode, expReason string
+	}{
+		{name: "response", resp: &http.Response{StatusCode: http.StatusServiceUnavailable}, expCode: "503"},
+		{name: "failed round trip", err: urlErr(syscall.ECONNREFUSED), expCode: CodeError, expReason: ReasonRefused},
+		{
+			name:    "invalid response keeps status code",
+			err:     urlErr(&InvalidResponseError{StatusCode: http.StatusOK, Err: errors.New("body does not match")}),
+			expCode: "200", expReason: ReasonInvalidResponse,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			code, reason := CodeAndReason(tcase.resp, tcase.err)
+			testutil.Equals(t, tcase.expCode, code)
+			testutil.Equals(t, tcase.expReason, reason)
+		})
+	}
+}
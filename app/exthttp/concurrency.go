@@ -0,0 +1,267 @@
+package exthttp
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Limiters of NewConcurrencyLimitMiddleware, deciding how many requests can be handled concurrently.
+const (
+	// ConcurrencyLimiterStatic keeps the configured limit.
+	ConcurrencyLimiterStatic = "static"
+	// ConcurrencyLimiterAIMD increases the limit by one while latency is below the threshold and the limit is
+	// actually used, and multiplies it by backoff ratio when latency crosses the threshold.
+	ConcurrencyLimiterAIMD = "aimd"
+	// ConcurrencyLimiterGradient adjusts the limit by the ratio of long-term to current latency, so the limit drops
+	// as soon as requests start to queue up, without any fixed latency threshold.
+	ConcurrencyLimiterGradient = "gradient"
+)
+
+// ConcurrencyLimitOption sets the value of an option for concurrency limit Middleware.
+type ConcurrencyLimitOption func(*concurrencyLimitOptions)
+
+type concurrencyLimitOptions struct {
+	initialLimit       int
+	minLimit, maxLimit int
+	latencyThreshold   time.Duration
+	backoffRatio       float64
+	tolerance          float64
+	retryAfter         time.Duration
+}
+
+// WithConcurrencyLimit sets the static limit or the initial limit of adaptive limiters. Default is 100.
+func WithConcurrencyLimit(limit int) ConcurrencyLimitOption {
+	return func(o *concurrencyLimitOptions) {
+		o.initialLimit = limit
+	}
+}
+
+// WithConcurrencyLimitBounds sets bounds of adaptive limits. Default is from 1 to 1000.
+func WithConcurrencyLimitBounds(min, max int) ConcurrencyLimitOption {
+	return func(o *concurrencyLimitOptions) {
+		o.minLimit = min
+		o.maxLimit = max
+	}
+}
+
+// WithAIMDLatencyThreshold sets the latency above which ConcurrencyLimiterAIMD decreases the limit, multiplying it
+// by backoffRatio. Default is 1s with 0.9 ratio.
+func WithAIMDLatencyThreshold(threshold time.Duration, backoffRatio float64) ConcurrencyLimitOption {
+	return func(o *concurrencyLimitOptions) {
+		o.latencyThreshold = threshold
+		o.backoffRatio = backoffRatio
+	}
+}
+
+// WithGradientTolerance sets how many times current latency of ConcurrencyLimiterGradient can be higher than
+// the long-term latency before the limit is decreased. Default is 1.5.
+func WithGradientTolerance(tolerance float64) ConcurrencyLimitOption {
+	return func(o *concurrencyLimitOptions) {
+		o.tolerance = tolerance
+	}
+}
+
+// WithRetryAfter sets the time shed requests are told to wait before retrying in Retry-After header. Default is 1s.
+func WithRetryAfter(d time.Duration) ConcurrencyLimitOption {
+	return func(o *concurrencyLimitOptions) {
+		o.retryAfter = d
+	}
+}
+
+type concurrencyLimitMiddleware struct {
+	reg        prometheus.Registerer
+	opts       concurrencyLimitOptions
+	newLimiter func() concurrencyLimiter
+}
+
+// NewConcurrencyLimitMiddleware provides Middleware that limits the number of requests each handler serves
+// concurrently, using the given limiter. Requests above the limit are shed right away with 503 and Retry-After
+// header, instead of queueing up until they time out. Limit, in-flight requests and shed requests are exposed as
+// metrics and shedding is recorded on the request span. When wrapped by InstrumentationMiddleware, shed requests
+// are observed with 503 code.
+func NewConcurrencyLimitMiddleware(reg prometheus.Registerer, limiter string, opts ...ConcurrencyLimitOption) (Middleware, error) {
+	o := concurrencyLimitOptions{
+		initialLimit:     100,
+		minLimit:         1,
+		maxLimit:         1000,
+		latencyThreshold: 1 * time.Second,
+		backoffRatio:     0.9,
+		tolerance:        1.5,
+		retryAfter:       1 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.initialLimit <= 0 {
+		return nil, errors.Errorf("concurrency limit has to be positive, got %v", o.initialLimit)
+	}
+	if o.minLimit <= 0 || o.minLimit > o.maxLimit {
+		return nil, errors.Errorf("invalid concurrency limit bounds [%v, %v]", o.minLimit, o.maxLimit)
+	}
+
+	m := &concurrencyLimitMiddleware{reg: reg, opts: o}
+	switch limiter {
+	case ConcurrencyLimiterStatic:
+		m.newLimiter = func() concurrencyLimiter { return staticLimiter(o.initialLimit) }
+	case ConcurrencyLimiterAIMD:
+		if o.backoffRatio <= 0 || o.backoffRatio >= 1 {
+			return nil, errors.Errorf("AIMD backoff ratio has to be within (0, 1), got %v", o.backoffRatio)
+		}
+		m.newLimiter = func() concurrencyLimiter { return &aimdLimiter{opts: o, value: o.clamp(o.initialLimit)} }
+	case ConcurrencyLimiterGradient:
+		if o.tolerance < 1 {
+			return nil, errors.Errorf("gradient tolerance has to be at least 1, got %v", o.tolerance)
+		}
+		m.newLimiter = func() concurrencyLimiter { return &gradientLimiter{opts: o, value: float64(o.clamp(o.initialLimit))} }
+	default:
+		return nil, errors.Errorf("unknown concurrency limiter %q, expected one of %v, %v, %v", limiter,
+			ConcurrencyLimiterStatic, ConcurrencyLimiterAIMD, ConcurrencyLimiterGradient)
+	}
+	return m, nil
+}
+
+func (m *concurrencyLimitMiddleware) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, m.reg)
+	var (
+		limit = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "http_concurrency_limit",
+			Help: "Tracks the current limit of concurrently handled HTTP requests.",
+		})
+		inFlight = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "http_concurrency_limit_inflight",
+			Help: "Tracks the number of HTTP requests currently handled within the concurrency limit.",
+		})
+		shed = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Tracks the number of HTTP requests rejected because of the concurrency limit.",
+		})
+
+		mu      sync.Mutex
+		l       = m.newLimiter()
+		current int
+	)
+	limit.Set(float64(l.get()))
+
+	retryAfter := strconv.Itoa(int(math.Ceil(m.opts.retryAfter.Seconds())))
+	return func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+
+		mu.Lock()
+		if current >= l.get() {
+			lim := l.get()
+			mu.Unlock()
+
+			shed.Inc()
+			span.SetAttributes(attribute.Bool("shed", true))
+			span.AddEvent("request shed", trace.WithAttributes(attribute.Int("concurrency.limit", lim)))
+
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, fmt.Sprintf("too many concurrent requests (limit %d), try again later", lim), http.StatusServiceUnavailable)
+			return
+		}
+		current++
+		inFlightAtStart := current
+		inFlight.Set(float64(current))
+		mu.Unlock()
+
+		start := time.Now()
+		defer func() {
+			rtt := time.Since(start)
+
+			mu.Lock()
+			defer mu.Unlock()
+			current--
+			inFlight.Set(float64(current))
+			l.observe(rtt, inFlightAtStart)
+			limit.Set(float64(l.get()))
+		}()
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func (o concurrencyLimitOptions) clamp(limit int) int {
+	if limit < o.minLimit {
+		return o.minLimit
+	}
+	if limit > o.maxLimit {
+		return o.maxLimit
+	}
+	return limit
+}
+
+// concurrencyLimiter decides the concurrency limit. It's not goroutine safe.
+type concurrencyLimiter interface {
+	get() int
+	// observe adjusts the limit based on the latency of the request and number of requests in flight when it started.
+	observe(rtt time.Duration, inFlight int)
+}
+
+type staticLimiter int
+
+func (l staticLimiter) get() int { return int(l) }
+
+func (staticLimiter) observe(time.Duration, int) {}
+
+type aimdLimiter struct {
+	opts  concurrencyLimitOptions
+	value int
+}
+
+func (l *aimdLimiter) get() int { return l.value }
+
+func (l *aimdLimiter) observe(rtt time.Duration, inFlight int) {
+	switch {
+	case rtt > l.opts.latencyThreshold:
+		l.value = l.opts.clamp(int(float64(l.value) * l.opts.backoffRatio))
+	case inFlight*2 >= l.value:
+		// Increase only if the limit is actually used, otherwise it grows without bounds during low traffic.
+		l.value = l.opts.clamp(l.value + 1)
+	}
+}
+
+// gradientLimiter is simplified Netflix gradient2 limiter, see https://github.com/Netflix/concurrency-limits.
+type gradientLimiter struct {
+	opts concurrencyLimitOptions
+	// value is kept as float, so small changes of smoothed limit add up.
+	value float64
+	// longRTT is exponentially weighted moving average of latency in seconds.
+	longRTT float64
+}
+
+// gradientSmoothing is the weight of new samples in long-term latency and limit averages.
+const gradientSmoothing = 0.05
+
+func (l *gradientLimiter) get() int { return int(l.value) }
+
+func (l *gradientLimiter) observe(rtt time.Duration, inFlight int) {
+	short := rtt.Seconds()
+	if short <= 0 {
+		return
+	}
+	if l.longRTT == 0 {
+		l.longRTT = short
+	}
+	l.longRTT = l.longRTT*(1-gradientSmoothing) + short*gradientSmoothing
+
+	// Don't grow the limit if it's not used.
+	if inFlight*2 < int(l.value) {
+		return
+	}
+
+	// Gradient below 1 means requests are slower than usual, so probably queueing.
+	gradient := math.Max(0.5, math.Min(1, l.opts.tolerance*l.longRTT/short))
+	// Square root of the limit leaves room for growth when latency is fine.
+	newLimit := l.value*gradient + math.Sqrt(l.value)
+	l.value = math.Max(float64(l.opts.minLimit), math.Min(float64(l.opts.maxLimit), l.value*(1-gradientSmoothing)+newLimit*gradientSmoothing))
+}
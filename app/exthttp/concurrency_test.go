@@ -0,0 +1,93 @@
+package exthttp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+type limiterObservation struct {
+	rtt      time.Duration
+	inFlight int
+}
+
+func testConcurrencyLimitOptions() concurrencyLimitOptions {
+	return concurrencyLimitOptions{
+		minLimit:         2,
+		maxLimit:         12,
+		latencyThreshold: 100 * time.Millisecond,
+		backoffRatio:     0.5,
+		tolerance:        1.5,
+	}
+}
+
+func TestAIMDLimiter_Observe(t *testing.T) {
+	for _, tcase := range []struct {
+		name         string
+		initial      int
+		observations []limiterObservation
+
+		expLimit int
+	}{
+		{name: "used limit grows", initial: 10, observations: []limiterObservation{{rtt: 10 * time.Millisecond, inFlight: 5}, {rtt: 10 * time.Millisecond, inFlight: 6}}, expLimit: 12},
+		{name: "unused limit does not grow", initial: 10, observations: []limiterObservation{{rtt: 10 * time.Millisecond, inFlight: 4}}, expLimit: 10},
+		{name: "limit is capped by max", initial: 12, observations: []limiterObservation{{rtt: 10 * time.Millisecond, inFlight: 12}}, expLimit: 12},
+		{name: "slow request decreases limit", initial: 10, observations: []limiterObservation{{rtt: 200 * time.Millisecond, inFlight: 1}}, expLimit: 5},
+		{name: "limit is capped by min", initial: 5, observations: []limiterObservation{{rtt: 200 * time.Millisecond}, {rtt: 200 * time.Millisecond}}, expLimit: 2},
+		{name: "threshold is not slow", initial: 10, observations: []limiterObservation{{rtt: 100 * time.Millisecond, inFlight: 5}}, expLimit: 11},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			l := &aimdLimiter{opts: testConcurrencyLimitOptions(), value: tcase.initial}
+			for _, o := range tcase.observations {
+				l.observe(o.rtt, o.inFlight)
+			}
+			testutil.Equals(t, tcase.expLimit, l.get())
+		})
+	}
+}
+
+func TestGradientLimiter_Observe(t *testing.T) {
+	t.Run("zero latency is ignored", func(t *testing.T) {
+		l := &gradientLimiter{opts: testConcurrencyLimitOptions(), value: 10}
+		l.observe(0, 10)
+		testutil.Equals(t, 10.0, l.value)
+		testutil.Equals(t, 0.0, l.longRTT)
+	})
+	t.Run("unused limit does not change", func(t *testing.T) {
+		l := &gradientLimiter{opts: testConcurrencyLimitOptions(), value: 10}
+		l.observe(100*time.Millisecond, 4)
+		testutil.Equals(t, 10.0, l.value)
+		testutil.Equals(t, 0.1, l.longRTT)
+	})
+	t.Run("steady latency grows limit up to max", func(t *testing.T) {
+		l := &gradientLimiter{opts: testConcurrencyLimitOptions(), value: 10}
+		l.observe(100*time.Millisecond, 10)
+		testutil.Assert(t, l.value > 10, "expected limit to grow, got %v", l.value)
+
+		for i := 0; i < 1000; i++ {
+			l.observe(100*time.Millisecond, 12)
+		}
+		testutil.Equals(t, 12, l.get())
+	})
+	t.Run("latency within tolerance grows limit", func(t *testing.T) {
+		l := &gradientLimiter{opts: testConcurrencyLimitOptions(), value: 10, longRTT: 0.1}
+		l.observe(140*time.Millisecond, 10)
+		testutil.Assert(t, l.value > 10, "expected limit to grow, got %v", l.value)
+	})
+	t.Run("latency increase decreases limit down to min", func(t *testing.T) {
+		opts := testConcurrencyLimitOptions()
+		opts.minLimit = 5
+		l := &gradientLimiter{opts: opts, value: 10, longRTT: 0.1}
+		l.observe(1*time.Second, 10)
+		testutil.Assert(t, l.value < 10, "expected limit to decrease, got %v", l.value)
+
+		// Latency keeps growing, so long-term average doesn't catch up.
+		rtt := 1 * time.Second
+		for i := 0; i < 200; i++ {
+			rtt = rtt * 11 / 10
+			l.observe(rtt, 10)
+		}
+		testutil.Equals(t, 5, l.get())
+	})
+}
@@ -0,0 +1,162 @@
+package exthttp
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Connection modes of transports created by NewTransport. Long-lived keep-alive connections stick to the few
+// backends behind e.g. Kubernetes Service, so modes other than pooled spread requests more evenly.
+const (
+	// ConnectionModePooled reuses keep-alive connections for as long as possible, same as http.DefaultTransport.
+	ConnectionModePooled = "pooled"
+	// ConnectionModePerRequest opens new connection for every request.
+	ConnectionModePerRequest = "per-request"
+	// ConnectionModeMaxAge reuses connections, but rotates all of them once they are older than configured max age.
+	ConnectionModeMaxAge = "max-age"
+	// ConnectionModeMaxRequests reuses connections, but rotates all of them after configured number of requests.
+	ConnectionModeMaxRequests = "max-requests"
+)
+
+// TransportOption configures transport created by NewTransport.
+type TransportOption func(*transportOptions)
+
+type transportOptions struct {
+	maxAge      time.Duration
+	maxRequests int
+}
+
+// WithConnectionMaxAge sets after how long connections are rotated in ConnectionModeMaxAge. Default is 30s.
+func WithConnectionMaxAge(d time.Duration) TransportOption {
+	return func(o *transportOptions) {
+		o.maxAge = d
+	}
+}
+
+// WithConnectionMaxRequests sets after how many requests connections are rotated in ConnectionModeMaxRequests.
+// Default is 100.
+func WithConnectionMaxRequests(n int) TransportOption {
+	return func(o *transportOptions) {
+		o.maxRequests = n
+	}
+}
+
+// NewTransport returns transport based on http.DefaultTransport that manages connections according to the given mode.
+func NewTransport(mode string, opts ...TransportOption) (http.RoundTripper, error) {
+	o := transportOptions{maxAge: 30 * time.Second, maxRequests: 100}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	switch mode {
+	case ConnectionModePooled:
+		return newDefaultTransport(), nil
+	case ConnectionModePerRequest:
+		t := newDefaultTransport()
+		t.DisableKeepAlives = true
+		return t, nil
+	case ConnectionModeMaxAge:
+		if o.maxAge <= 0 {
+			return nil, errors.Errorf("connection max age has to be positive, got %v", o.maxAge)
+		}
+		return newRotatingTransport(o.maxAge, 0), nil
+	case ConnectionModeMaxRequests:
+		if o.maxRequests <= 0 {
+			return nil, errors.Errorf("connection max requests has to be positive, got %v", o.maxRequests)
+		}
+		return newRotatingTransport(0, o.maxRequests), nil
+	default:
+		return nil, errors.Errorf("unknown connection mode %q, expected one of %v, %v, %v, %v", mode,
+			ConnectionModePooled, ConnectionModePerRequest, ConnectionModeMaxAge, ConnectionModeMaxRequests)
+	}
+}
+
+func newDefaultTransport() *http.Transport {
+	return http.DefaultTransport.(*http.Transport).Clone()
+}
+
+// rotationGrace is how long rotated transport is kept before its connections, returned by requests that were in
+// flight during rotation, are closed.
+const rotationGrace = 1 * time.Minute
+
+// rotatingTransport replaces underlying transport, and so all its connections, once it is too old or served too
+// many requests. Zero limit means no limit.
+type rotatingTransport struct {
+	maxAge      time.Duration
+	maxRequests int
+
+	mu       sync.Mutex
+	current  *http.Transport
+	created  time.Time
+	requests int
+}
+
+func newRotatingTransport(maxAge time.Duration, maxRequests int) *rotatingTransport {
+	return &rotatingTransport{maxAge: maxAge, maxRequests: maxRequests, current: newDefaultTransport(), created: time.Now()}
+}
+
+func (r *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.transport().RoundTrip(req)
+}
+
+func (r *rotatingTransport) transport() *http.Transport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if (r.maxAge > 0 && time.Since(r.created) >= r.maxAge) || (r.maxRequests > 0 && r.requests >= r.maxRequests) {
+		old := r.current
+		old.CloseIdleConnections()
+		// Requests in flight return their connections to the old pool, close them once they finished.
+		time.AfterFunc(rotationGrace, old.CloseIdleConnections)
+
+		r.current, r.created, r.requests = newDefaultTransport(), time.Now(), 0
+	}
+	r.requests++
+	return r.current
+}
+
+// CloseIdleConnections implements the interface used by http.Client.CloseIdleConnections.
+func (r *rotatingTransport) CloseIdleConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.CloseIdleConnections()
+}
+
+// NewConnectionReuseTripperware returns Tripperware that tracks whether requests reused existing connection using
+// httptrace. It should be placed right above the transport, so every attempt is tracked.
+func NewConnectionReuseTripperware(reg prometheus.Registerer) Tripperware {
+	return &connectionReuseTripperware{reg: reg}
+}
+
+type connectionReuseTripperware struct {
+	reg prometheus.Registerer
+}
+
+func (c *connectionReuseTripperware) WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": targetName}, c.reg)
+	conns := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "http_client_connections_total",
+		Help: "Tracks the number of connections obtained for HTTP requests, by whether existing connection was reused.",
+	}, []string{"reused"})
+
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		span := trace.SpanFromContext(req.Context())
+		ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				conns.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+				span.SetAttributes(attribute.Bool("net.conn.reused", info.Reused))
+			},
+		})
+		return next.RoundTrip(req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,107 @@
+package exthttp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exportedConnections returns the number of obtained connections exported by connection reuse metrics.
+func exportedConnections(t *testing.T, reg *prometheus.Registry, reused string) int {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "http_client_connections_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "reused" && l.GetValue() == reused {
+					return int(m.GetCounter().GetValue())
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestNewTransport(t *testing.T) {
+	var newConns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for _, tcase := range []struct {
+		name string
+		mode string
+		opts []TransportOption
+		// pauseAfter pauses after given number of requests.
+		pauseAfter int
+		pause      time.Duration
+
+		expErr   bool
+		expConns int
+	}{
+		{name: "pooled", mode: ConnectionModePooled, expConns: 1},
+		{name: "per request", mode: ConnectionModePerRequest, expConns: 6},
+		{name: "max requests", mode: ConnectionModeMaxRequests, opts: []TransportOption{WithConnectionMaxRequests(2)}, expConns: 3},
+		{name: "max requests above requests", mode: ConnectionModeMaxRequests, opts: []TransportOption{WithConnectionMaxRequests(10)}, expConns: 1},
+		{
+			name:       "max age",
+			mode:       ConnectionModeMaxAge,
+			opts:       []TransportOption{WithConnectionMaxAge(200 * time.Millisecond)},
+			pauseAfter: 3,
+			pause:      250 * time.Millisecond,
+			expConns:   2,
+		},
+		{name: "max age not positive", mode: ConnectionModeMaxAge, opts: []TransportOption{WithConnectionMaxAge(0)}, expErr: true},
+		{name: "max requests not positive", mode: ConnectionModeMaxRequests, opts: []TransportOption{WithConnectionMaxRequests(-1)}, expErr: true},
+		{name: "unknown mode", mode: "sticky", expErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			transport, err := NewTransport(tcase.mode, tcase.opts...)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			defer transport.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+
+			reg := prometheus.NewRegistry()
+			client := &http.Client{Transport: NewConnectionReuseTripperware(reg).WrapRoundTripper("app", transport)}
+
+			atomic.StoreInt64(&newConns, 0)
+			for i := 0; i < 6; i++ {
+				if tcase.pauseAfter > 0 && i == tcase.pauseAfter {
+					time.Sleep(tcase.pause)
+				}
+				resp, err := client.Get(srv.URL)
+				testutil.Ok(t, err)
+				// Connections are reused only if the body was read and closed.
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+				testutil.Ok(t, resp.Body.Close())
+			}
+
+			testutil.Equals(t, tcase.expConns, int(atomic.LoadInt64(&newConns)))
+			testutil.Equals(t, tcase.expConns, exportedConnections(t, reg, "false"))
+			testutil.Equals(t, 6-tcase.expConns, exportedConnections(t, reg, "true"))
+		})
+	}
+}
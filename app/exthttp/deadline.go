@@ -0,0 +1,85 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TimeoutHeader carries the time in milliseconds the client is still willing to wait for the response.
+const TimeoutHeader = "X-Request-Timeout-Ms"
+
+type deadlineTripperware struct{}
+
+// NewDeadlineTripperware provides Tripperware that propagates remaining time of the request context deadline
+// in TimeoutHeader, so the server can stop working on the request the client gave up on.
+func NewDeadlineTripperware() Tripperware {
+	return deadlineTripperware{}
+}
+
+func (deadlineTripperware) WrapRoundTripper(_ string, next http.RoundTripper) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		deadline, ok := req.Context().Deadline()
+		if !ok {
+			return next.RoundTrip(req)
+		}
+
+		req = req.Clone(req.Context())
+		req.Header.Set(TimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+		return next.RoundTrip(req)
+	})
+}
+
+type deadlineMiddleware struct {
+	reg prometheus.Registerer
+}
+
+// NewDeadlineMiddleware provides Middleware that turns TimeoutHeader into the request context deadline.
+// Requests that ran out of time are counted in http_request_deadline_exceeded_total and marked on the span.
+func NewDeadlineMiddleware(reg prometheus.Registerer) Middleware {
+	return &deadlineMiddleware{reg: reg}
+}
+
+func (d *deadlineMiddleware) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, d.reg)
+	deadlineExceeded := promauto.With(reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_request_deadline_exceeded_total",
+			Help: "Tracks the number of HTTP requests that were still handled when client deadline passed.",
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.ParseInt(r.Header.Get(TimeoutHeader), 10, 64)
+		if err != nil {
+			// No (valid) deadline from client.
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.Int64("client.timeout_ms", ms))
+
+		deadline := time.Now().Add(time.Duration(ms) * time.Millisecond)
+		// Count only requests that ran out of client time, not the time of the server itself (e.g. handler timeout).
+		clientFirst := true
+		if parent, ok := r.Context().Deadline(); ok {
+			clientFirst = deadline.Before(parent)
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		if clientFirst && ctx.Err() == context.DeadlineExceeded {
+			deadlineExceeded.Inc()
+			span.SetAttributes(attribute.Bool("deadline_exceeded", true))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDeadlineMiddleware(t *testing.T) {
+	for _, tcase := range []struct {
+		name           string
+		timeoutHeader  string
+		serverDeadline time.Duration
+
+		expExceeded float64
+	}{
+		{name: "no client deadline", serverDeadline: 20 * time.Millisecond},
+		{name: "client deadline exceeded", timeoutHeader: "20", expExceeded: 1},
+		{name: "client deadline exceeded before server one", timeoutHeader: "20", serverDeadline: time.Minute, expExceeded: 1},
+		{name: "server deadline exceeded before client one", timeoutHeader: "60000", serverDeadline: 20 * time.Millisecond},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			h := NewDeadlineMiddleware(reg).WrapHandler("/ping", http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+
+			ctx := context.Background()
+			if tcase.serverDeadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tcase.serverDeadline)
+				defer cancel()
+			}
+			req := httptest.NewRequest(http.MethodGet, "/ping", nil).WithContext(ctx)
+			if tcase.timeoutHeader != "" {
+				req.Header.Set(TimeoutHeader, tcase.timeoutHeader)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			testutil.Equals(t, tcase.expExceeded, counterValue(t, reg, "http_request_deadline_exceeded_total"))
+		})
+	}
+}
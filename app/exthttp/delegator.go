@@ -0,0 +1,420 @@
+// Adapted from https://github.com/prometheus/client_golang/blob/v1.10.0/prometheus/promhttp/delegator.go
+
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exthttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// responseWriterDelegator implements http.ResponseWriter and extracts the statusCode, number of bytes written
+// and the time the response started.
+type responseWriterDelegator struct {
+	w            http.ResponseWriter
+	written      bool
+	statusCode   int
+	bytesWritten int64
+	firstByte    time.Time
+
+	// beforeFirstByte, if set, is called once before status code and headers are sent, so it can still modify headers.
+	beforeFirstByte func()
+}
+
+func newResponseWriterDelegator(w http.ResponseWriter) *responseWriterDelegator {
+	return &responseWriterDelegator{w: w}
+}
+
+// wrapped returns the delegator as http.ResponseWriter implementing the same optional interfaces as the underlying
+// writer, so e.g streaming or websocket handlers keep working when instrumented.
+func (wd *responseWriterDelegator) wrapped() http.ResponseWriter {
+	return pickDelegator[optionalInterfaces(wd.w)](wd)
+}
+
+func (wd *responseWriterDelegator) Header() http.Header {
+	return wd.w.Header()
+}
+
+func (wd *responseWriterDelegator) Write(bytes []byte) (int, error) {
+	wd.observeWrite()
+	n, err := wd.w.Write(bytes)
+	wd.bytesWritten += int64(n)
+	return n, err
+}
+
+func (wd *responseWriterDelegator) WriteHeader(statusCode int) {
+	if !wd.written {
+		wd.observeFirstByte()
+		wd.written = true
+		wd.statusCode = statusCode
+	}
+	// Superfluous calls are passed too, so the underlying writer can log them.
+	wd.w.WriteHeader(statusCode)
+}
+
+func (wd *responseWriterDelegator) StatusCode() int {
+	if !wd.written {
+		return http.StatusOK
+	}
+	return wd.statusCode
+}
+
+func (wd *responseWriterDelegator) Status() string {
+	return fmt.Sprintf("%d", wd.StatusCode())
+}
+
+func (wd *responseWriterDelegator) BytesWritten() int64 {
+	return wd.bytesWritten
+}
+
+// FirstByte returns the time of the first WriteHeader or Write call, or zero time if there was none.
+func (wd *responseWriterDelegator) FirstByte() time.Time {
+	return wd.firstByte
+}
+
+func (wd *responseWriterDelegator) observeFirstByte() {
+	if !wd.firstByte.IsZero() {
+		return
+	}
+	if wd.beforeFirstByte != nil {
+		wd.beforeFirstByte()
+	}
+	wd.firstByte = time.Now()
+}
+
+// observeWrite records the implicit 200 status code, sent by the underlying writer on the first body write or flush.
+func (wd *responseWriterDelegator) observeWrite() {
+	if !wd.written {
+		wd.observeFirstByte()
+		wd.written = true
+		wd.statusCode = http.StatusOK
+	}
+}
+
+//nolint:staticcheck // Deprecated, but still used by some handlers.
+func (wd *responseWriterDelegator) CloseNotify() <-chan bool {
+	return wd.w.(http.CloseNotifier).CloseNotify()
+}
+
+func (wd *responseWriterDelegator) Flush() {
+	wd.observeWrite()
+	wd.w.(http.Flusher).Flush()
+}
+
+func (wd *responseWriterDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return wd.w.(http.Hijacker).Hijack()
+}
+
+func (wd *responseWriterDelegator) ReadFrom(r io.Reader) (int64, error) {
+	wd.observeWrite()
+	n, err := wd.w.(io.ReaderFrom).ReadFrom(r)
+	wd.bytesWritten += n
+	return n, err
+}
+
+func (wd *responseWriterDelegator) Push(target string, opts *http.PushOptions) error {
+	return wd.w.(http.Pusher).Push(target, opts)
+}
+
+// optionalResponseWriter is implemented by writers wrapping another http.ResponseWriter, which delegate optional
+// interfaces to it. They have to be exposed by pickDelegator, so only interfaces the wrapped writer implements are visible.
+type optionalResponseWriter interface {
+	http.ResponseWriter
+	http.CloseNotifier
+	http.Flusher
+	http.Hijacker
+	io.ReaderFrom
+	http.Pusher
+}
+
+// Bits of optional interfaces implemented by the underlying writer, used as index of pickDelegator.
+const (
+	closeNotifier = 1 << iota
+	flusher
+	hijacker
+	readerFrom
+	pusher
+)
+
+// optionalInterfaces returns bits of optional interfaces implemented by w.
+func optionalInterfaces(w http.ResponseWriter) int {
+	id := 0
+	//nolint:staticcheck // Deprecated, but still used by some handlers.
+	if _, ok := w.(http.CloseNotifier); ok {
+		id += closeNotifier
+	}
+	if _, ok := w.(http.Flusher); ok {
+		id += flusher
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		id += hijacker
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		id += readerFrom
+	}
+	if _, ok := w.(http.Pusher); ok {
+		id += pusher
+	}
+	return id
+}
+
+// pickDelegator exposes the given combination of optional interfaces of the writer, hiding the others.
+// Same approach as in promhttp.
+var pickDelegator = [pusher << 1]func(optionalResponseWriter) http.ResponseWriter{
+	0: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+		}{w}
+	},
+	closeNotifier: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+		}{w, w}
+	},
+	flusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, w}
+	},
+	closeNotifier + flusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+		}{w, w, w}
+	},
+	hijacker: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, w}
+	},
+	closeNotifier + hijacker: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+		}{w, w, w}
+	},
+	flusher + hijacker: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	},
+	closeNotifier + flusher + hijacker: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+		}{w, w, w, w}
+	},
+	readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{w, w}
+	},
+	closeNotifier + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w}
+	},
+	flusher + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w}
+	},
+	closeNotifier + flusher + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w, w}
+	},
+	hijacker + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w}
+	},
+	closeNotifier + hijacker + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	},
+	flusher + hijacker + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	},
+	closeNotifier + flusher + hijacker + readerFrom: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	},
+	pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, w}
+	},
+	closeNotifier + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Pusher
+		}{w, w, w}
+	},
+	flusher + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	},
+	closeNotifier + flusher + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Pusher
+		}{w, w, w, w}
+	},
+	hijacker + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	},
+	closeNotifier + hijacker + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	},
+	flusher + hijacker + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	},
+	closeNotifier + flusher + hijacker + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w, w}
+	},
+	readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w}
+	},
+	closeNotifier + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	},
+	flusher + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	},
+	closeNotifier + flusher + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w}
+	},
+	hijacker + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	},
+	closeNotifier + hijacker + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w}
+	},
+	flusher + hijacker + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w}
+	},
+	closeNotifier + flusher + hijacker + readerFrom + pusher: func(w optionalResponseWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w, w}
+	},
+}
@@ -0,0 +1,456 @@
+package exthttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+// fakeWriter implements http.ResponseWriter and all optional interfaces, recording what was called.
+type fakeWriter struct {
+	header     http.Header
+	statusCode int
+	body       strings.Builder
+	calls      []string
+}
+
+func newFakeWriter() *fakeWriter { return &fakeWriter{header: http.Header{}} }
+
+func (f *fakeWriter) Header() http.Header { return f.header }
+
+func (f *fakeWriter) Write(b []byte) (int, error) {
+	if f.statusCode == 0 {
+		f.statusCode = http.StatusOK
+	}
+	return f.body.Write(b)
+}
+
+func (f *fakeWriter) WriteHeader(statusCode int) {
+	if f.statusCode == 0 {
+		f.statusCode = statusCode
+	}
+}
+
+func (f *fakeWriter) CloseNotify() <-chan bool {
+	f.calls = append(f.calls, "CloseNotify")
+	return nil
+}
+
+func (f *fakeWriter) Flush() {
+	f.calls = append(f.calls, "Flush")
+	if f.statusCode == 0 {
+		f.statusCode = http.StatusOK
+	}
+}
+
+func (f *fakeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	f.calls = append(f.calls, "Hijack")
+	return nil, nil, nil
+}
+
+func (f *fakeWriter) ReadFrom(r io.Reader) (int64, error) {
+	f.calls = append(f.calls, "ReadFrom")
+	if f.statusCode == 0 {
+		f.statusCode = http.StatusOK
+	}
+	b, err := ioutil.ReadAll(r)
+	f.body.Write(b)
+	return int64(len(b)), err
+}
+
+func (f *fakeWriter) Push(string, *http.PushOptions) error {
+	f.calls = append(f.calls, "Push")
+	return nil
+}
+
+// innerWriters expose only the given combination of optional interfaces of fakeWriter.
+var innerWriters = [pusher << 1]func(f *fakeWriter) http.ResponseWriter{
+	0: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+		}{f}
+	},
+	closeNotifier: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+		}{f, f}
+	},
+	flusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{f, f}
+	},
+	closeNotifier + flusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+		}{f, f, f}
+	},
+	hijacker: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{f, f}
+	},
+	closeNotifier + hijacker: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+		}{f, f, f}
+	},
+	flusher + hijacker: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{f, f, f}
+	},
+	closeNotifier + flusher + hijacker: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+		}{f, f, f, f}
+	},
+	readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{f, f}
+	},
+	closeNotifier + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{f, f, f}
+	},
+	flusher + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{f, f, f}
+	},
+	closeNotifier + flusher + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+		}{f, f, f, f}
+	},
+	hijacker + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{f, f, f}
+	},
+	closeNotifier + hijacker + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{f, f, f, f}
+	},
+	flusher + hijacker + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{f, f, f, f}
+	},
+	closeNotifier + flusher + hijacker + readerFrom: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{f, f, f, f, f}
+	},
+	pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{f, f}
+	},
+	closeNotifier + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Pusher
+		}{f, f, f}
+	},
+	flusher + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{f, f, f}
+	},
+	closeNotifier + flusher + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Pusher
+		}{f, f, f, f}
+	},
+	hijacker + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{f, f, f}
+	},
+	closeNotifier + hijacker + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{f, f, f, f}
+	},
+	flusher + hijacker + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{f, f, f, f}
+	},
+	closeNotifier + flusher + hijacker + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{f, f, f, f, f}
+	},
+	readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f}
+	},
+	closeNotifier + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f}
+	},
+	flusher + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f}
+	},
+	closeNotifier + flusher + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f, f}
+	},
+	hijacker + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f}
+	},
+	closeNotifier + hijacker + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f, f}
+	},
+	flusher + hijacker + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f, f}
+	},
+	closeNotifier + flusher + hijacker + readerFrom + pusher: func(f *fakeWriter) http.ResponseWriter {
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{f, f, f, f, f, f}
+	},
+}
+
+func TestResponseWriterDelegator_Interfaces(t *testing.T) {
+	for id, inner := range innerWriters {
+		t.Run(fmt.Sprintf("interfaces=%05b", id), func(t *testing.T) {
+			f := newFakeWriter()
+			w := inner(f)
+			testutil.Equals(t, id, optionalInterfaces(w))
+
+			wd := newResponseWriterDelegator(w)
+			wrapped := wd.wrapped()
+			testutil.Equals(t, id, optionalInterfaces(wrapped))
+
+			// Optional interfaces have to reach the inner writer.
+			var expCalls []string
+			//nolint:staticcheck // Deprecated, but still used by some handlers.
+			if cn, ok := wrapped.(http.CloseNotifier); ok {
+				cn.CloseNotify()
+				expCalls = append(expCalls, "CloseNotify")
+			}
+			if h, ok := wrapped.(http.Hijacker); ok {
+				_, _, _ = h.Hijack()
+				expCalls = append(expCalls, "Hijack")
+			}
+			if p, ok := wrapped.(http.Pusher); ok {
+				testutil.Ok(t, p.Push("/style.css", nil))
+				expCalls = append(expCalls, "Push")
+			}
+			testutil.Equals(t, expCalls, f.calls)
+		})
+	}
+}
+
+func TestResponseWriterDelegator_Tracking(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		// needs is the optional interface the inner writer needs for this case.
+		needs int
+		write func(w http.ResponseWriter)
+
+		expStatus    string
+		expBytes     int64
+		expFirstByte bool
+	}{
+		{
+			name:      "nothing written",
+			write:     func(http.ResponseWriter) {},
+			expStatus: "200",
+		},
+		{
+			name:         "Write",
+			write:        func(w http.ResponseWriter) { _, _ = w.Write([]byte("pong\n")) },
+			expStatus:    "200",
+			expBytes:     5,
+			expFirstByte: true,
+		},
+		{
+			name: "WriteHeader and Write",
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte("not found"))
+				// Superfluous, status is already sent.
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expStatus:    "404",
+			expBytes:     9,
+			expFirstByte: true,
+		},
+		{
+			name: "Write and WriteHeader",
+			write: func(w http.ResponseWriter) {
+				_, _ = w.Write([]byte("pong"))
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expStatus:    "200",
+			expBytes:     4,
+			expFirstByte: true,
+		},
+		{
+			name:  "Flush and WriteHeader",
+			needs: flusher,
+			write: func(w http.ResponseWriter) {
+				w.(http.Flusher).Flush()
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expStatus:    "200",
+			expFirstByte: true,
+		},
+		{
+			name:  "ReadFrom",
+			needs: readerFrom,
+			write: func(w http.ResponseWriter) {
+				_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("streamed"))
+			},
+			expStatus:    "200",
+			expBytes:     8,
+			expFirstByte: true,
+		},
+		{
+			name:  "WriteHeader, ReadFrom and Write",
+			needs: readerFrom,
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("abc"))
+				_, _ = w.Write([]byte("de"))
+			},
+			expStatus:    "201",
+			expBytes:     5,
+			expFirstByte: true,
+		},
+	} {
+		for id, inner := range innerWriters {
+			if id&tcase.needs != tcase.needs {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/interfaces=%05b", tcase.name, id), func(t *testing.T) {
+				f := newFakeWriter()
+				wd := newResponseWriterDelegator(inner(f))
+
+				hookCalls := 0
+				wd.beforeFirstByte = func() {
+					hookCalls++
+					// Headers can still be modified.
+					testutil.Equals(t, 0, f.statusCode)
+					wd.Header().Set("Server-Timing", "total;dur=1")
+				}
+				tcase.write(wd.wrapped())
+
+				testutil.Equals(t, tcase.expStatus, wd.Status())
+				testutil.Equals(t, tcase.expBytes, wd.BytesWritten())
+				testutil.Equals(t, int64(f.body.Len()), wd.BytesWritten())
+				testutil.Equals(t, tcase.expFirstByte, !wd.FirstByte().IsZero())
+				if !tcase.expFirstByte {
+					testutil.Equals(t, 0, hookCalls)
+					return
+				}
+				testutil.Equals(t, 1, hookCalls)
+				testutil.Equals(t, "total;dur=1", f.header.Get("Server-Timing"))
+			})
+		}
+	}
+}
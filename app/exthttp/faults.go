@@ -0,0 +1,167 @@
+package exthttp
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrInjectedFault is returned by fault injection RoundTripper instead of sending the request, simulating broken
+// connection. It is classified with its own reason, so injected errors can be told apart from real ones.
+var ErrInjectedFault = errInjectedFault{}
+
+type errInjectedFault struct{}
+
+func (errInjectedFault) Error() string { return "injected connection error" }
+
+// FaultOption sets the value of an option for fault injection Tripperware.
+type FaultOption func(*faultOptions)
+
+type faultOptions struct {
+	latency        time.Duration
+	jitter         time.Duration
+	errorRatio     float64
+	bytesPerSecond int
+}
+
+// WithFaultLatency adds latency to every request before it is sent. Actual latency is chosen randomly from
+// latency +/- jitter.
+func WithFaultLatency(latency, jitter time.Duration) FaultOption {
+	return func(o *faultOptions) {
+		o.latency = latency
+		o.jitter = jitter
+	}
+}
+
+// WithFaultConnectionErrors fails the given ratio (0-1) of requests with ErrInjectedFault without sending them.
+func WithFaultConnectionErrors(ratio float64) FaultOption {
+	return func(o *faultOptions) {
+		o.errorRatio = ratio
+	}
+}
+
+// WithFaultBandwidth throttles both request and response bodies to the given number of bytes per second.
+// Response body is throttled while it is read, after the round trip returned, so the slowdown is not part of
+// http_client_request_duration_seconds, which ends with response headers. It shows in the transfer phase of phase
+// metrics and in the latency of the caller that reads the whole body.
+func WithFaultBandwidth(bytesPerSecond int) FaultOption {
+	return func(o *faultOptions) {
+		o.bytesPerSecond = bytesPerSecond
+	}
+}
+
+// Injected fault types used as "fault" label.
+const (
+	faultLatency         = "latency"
+	faultConnectionError = "connection_error"
+	faultBandwidth       = "bandwidth"
+)
+
+type faultTripperware struct {
+	reg  prometheus.Registerer
+	opts faultOptions
+}
+
+// NewFaultInjectionTripperware returns Tripperware simulating poor network between client and server: latency with
+// jitter, connection errors and limited bandwidth. Injected faults are counted and recorded as attributes of the request
+// span. It should be placed right above the transport, so every attempt is affected. Without options it does nothing.
+func NewFaultInjectionTripperware(reg prometheus.Registerer, opts ...FaultOption) Tripperware {
+	f := &faultTripperware{reg: reg}
+	for _, o := range opts {
+		o(&f.opts)
+	}
+	return f
+}
+
+func (f *faultTripperware) WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": targetName}, f.reg)
+	injected := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "http_client_injected_faults_total",
+		Help: "Tracks the number of requests affected by injected network faults.",
+	}, []string{"fault"})
+
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		span := trace.SpanFromContext(req.Context())
+
+		if d := f.latency(); d > 0 {
+			injected.WithLabelValues(faultLatency).Inc()
+			span.SetAttributes(attribute.Int64("fault.latency_ms", d.Milliseconds()))
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(d):
+			}
+		}
+
+		if f.opts.errorRatio > 0 && rand.Float64() < f.opts.errorRatio {
+			injected.WithLabelValues(faultConnectionError).Inc()
+			span.SetAttributes(attribute.Bool("fault.connection_error", true))
+			return nil, ErrInjectedFault
+		}
+
+		if f.opts.bytesPerSecond <= 0 {
+			return next.RoundTrip(req)
+		}
+
+		injected.WithLabelValues(faultBandwidth).Inc()
+		span.SetAttributes(attribute.Int("fault.bandwidth_bytes_per_second", f.opts.bytesPerSecond))
+		if req.Body != nil && req.Body != http.NoBody {
+			body := req.Body
+			req = req.Clone(req.Context())
+			req.Body = newThrottledReader(req.Context(), body, f.opts.bytesPerSecond)
+		}
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		resp.Body = newThrottledReader(req.Context(), resp.Body, f.opts.bytesPerSecond)
+		return resp, nil
+	})
+}
+
+func (f *faultTripperware) latency() time.Duration {
+	d := f.opts.latency
+	if f.opts.jitter > 0 {
+		d += time.Duration(rand.Int63n(2*int64(f.opts.jitter)+1)) - f.opts.jitter
+	}
+	return d
+}
+
+// throttledReader reads in small chunks and sleeps after each of them, so reading is not faster than bytesPerSecond.
+type throttledReader struct {
+	ctx            context.Context
+	r              io.ReadCloser
+	bytesPerSecond int
+}
+
+func newThrottledReader(ctx context.Context, r io.ReadCloser, bytesPerSecond int) io.ReadCloser {
+	return &throttledReader{ctx: ctx, r: r, bytesPerSecond: bytesPerSecond}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read at most 100ms worth of data at once, so throttling is smooth.
+	if chunk := t.bytesPerSecond/10 + 1; len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		select {
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		case <-time.After(time.Duration(n) * time.Second / time.Duration(t.bytesPerSecond)):
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.r.Close()
+}
@@ -0,0 +1,55 @@
+package exthttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestFaultInjection(t *testing.T) {
+	const body = "0123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789"
+
+	next := promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	t.Run("connection errors", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		rt := NewFaultInjectionTripperware(reg, WithFaultConnectionErrors(1)).WrapRoundTripper("app", next)
+
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+		testutil.Equals(t, ErrInjectedFault, err)
+		testutil.Equals(t, 1.0, counterValue(t, reg, "http_client_injected_faults_total"))
+	})
+	t.Run("latency", func(t *testing.T) {
+		rt := NewFaultInjectionTripperware(prometheus.NewRegistry(), WithFaultLatency(50*time.Millisecond, 0)).WrapRoundTripper("app", next)
+
+		start := time.Now()
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+		testutil.Ok(t, err)
+		testutil.Assert(t, time.Since(start) >= 50*time.Millisecond, "latency was not injected")
+	})
+	t.Run("bandwidth slows only body reads", func(t *testing.T) {
+		rt := NewFaultInjectionTripperware(prometheus.NewRegistry(), WithFaultBandwidth(1000)).WrapRoundTripper("app", next)
+
+		start := time.Now()
+		resp, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://app/ping", nil))
+		testutil.Ok(t, err)
+		roundTrip := time.Since(start)
+		testutil.Assert(t, roundTrip < 50*time.Millisecond, "round trip was throttled, took %v", roundTrip)
+
+		b, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+		testutil.Equals(t, body, string(b))
+		// 100 bytes at 1000 bytes per second.
+		testutil.Assert(t, time.Since(start) >= 100*time.Millisecond, "body read was not throttled, took %v", time.Since(start))
+	})
+}
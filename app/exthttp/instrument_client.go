@@ -4,7 +4,6 @@
 package exthttp
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -14,11 +13,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel/trace"
 )
 
-var emptyTraceCtx = trace.SpanContext{}
-
 // InstrumentationTripperware holds necessary metrics to instrument an http.RoundTripper
 // and provides necessary behaviors.
 type InstrumentationTripperware interface {
@@ -37,74 +33,83 @@ func NewNopInstrumentationTripperware() InstrumentationTripperware {
 }
 
 type instrumentationTripperware struct {
-	reg     prometheus.Registerer
-	tp      *tracing.Provider
-	buckets []float64
+	reg  prometheus.Registerer
+	tp   *tracing.Provider
+	opts instrumentationOptions
 }
 
 // NewInstrumentationTripperware provides default InstrumentationTripperware.
-// Passing nil as buckets uses the default buckets.
-// TODO(bwplotka): Add optional args.
-func NewInstrumentationTripperware(reg prometheus.Registerer, buckets []float64, tp *tracing.Provider) InstrumentationTripperware {
-	if buckets == nil {
-		buckets = []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120, 240, 360, 720}
-	}
-
-	return &instrumentationTripperware{reg: reg, buckets: buckets, tp: tp}
+// If tp is not nil, requests are also traced.
+func NewInstrumentationTripperware(reg prometheus.Registerer, tp *tracing.Provider, opts ...InstrumentationOption) InstrumentationTripperware {
+	return &instrumentationTripperware{reg: reg, tp: tp, opts: newInstrumentationOptions(opts)}
 }
 
 func (ins *instrumentationTripperware) WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper {
-	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": targetName}, ins.reg)
-	requestDuration := promauto.With(reg).NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_client_request_duration_seconds",
-			Help:    "Tracks the latencies for HTTP requests.",
-			Buckets: ins.buckets,
-		},
-		[]string{"method", "code"},
-	)
+	var (
+		reg        = ins.opts.registerer(ins.reg, "target", targetName)
+		labelNames = ins.opts.labelNames("method", "code", "reason")
 
-	requestsTotal := promauto.With(reg).NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_client_requests_total",
-			Help: "Tracks the number of HTTP requests.",
-		}, []string{"method", "code"},
+		requestDuration *prometheus.HistogramVec
+		requestsTotal   *prometheus.CounterVec
 	)
+	if ins.opts.enabled(MetricClientRequestDuration) {
+		requestDuration = promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricClientRequestDuration,
+				Help:      "Tracks the latencies for HTTP requests.",
+				Buckets:   ins.opts.bucketsFor(targetName),
+			},
+			labelNames,
+		)
+	}
+	if ins.opts.enabled(MetricClientRequestsTotal) {
+		requestsTotal = promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricClientRequestsTotal,
+				Help:      "Tracks the number of HTTP requests.",
+			}, labelNames,
+		)
+	}
+	if ins.opts.phaseBuckets != nil && ins.opts.enabled(MetricClientPhaseDuration) {
+		phases, inner := newPhaseMetrics(reg, ins.opts), next
+		next = promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return phases.roundTrip(inner, req)
+		})
+	}
 
-	requestsInFlight := promauto.With(reg).NewGauge(
-		prometheus.GaugeOpts{
-			Name: "http_client_requests_inflight",
-			Help: "Tracks the number of HTTP requests currently in flight.",
-		},
-	)
-
-	base := promhttp.InstrumentRoundTripperInFlight(
-		requestsInFlight,
-		// TODO(bwplotka): Can't use promhttp.InstrumentRoundTripperCounter or promhttp.InstrumentRoundTripperDuration, propose exemplars feature.
-		promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
-			now := time.Now()
-			resp, err := next.RoundTrip(req)
-			if err != nil {
-				return resp, err
-			}
-
-			cntr := requestsTotal.WithLabelValues(strings.ToLower(req.Method), fmt.Sprintf("%d", resp.StatusCode))
-			observer := requestDuration.WithLabelValues(strings.ToLower(req.Method), fmt.Sprintf("%d", resp.StatusCode))
-			// If we find a TraceID from OpenTelemetry we'll expose it as Exemplar.
-
-			if spanCtx := trace.SpanContextFromContext(req.Context()); spanCtx.HasTraceID() && spanCtx.IsSampled() {
-				traceID := prometheus.Labels{"traceID": spanCtx.TraceID().String()}
-
-				cntr.(prometheus.ExemplarAdder).AddWithExemplar(1, traceID)
-				observer.(prometheus.ExemplarObserver).ObserveWithExemplar(time.Since(now).Seconds(), traceID)
-				return resp, err
-			}
-
-			cntr.Inc()
-			observer.Observe(time.Since(now).Seconds())
-			return resp, err
-		}),
-	)
+	// Can't use promhttp.InstrumentRoundTripperCounter or promhttp.InstrumentRoundTripperDuration, as they don't support exemplars.
+	var base http.RoundTripper = promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		now := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		// Failed round trips are tracked with bounded reason and "error" code, unless response was received.
+		code, reason := CodeAndReason(resp, err)
+
+		// If we find a TraceID from OpenTelemetry we'll expose it as Exemplar.
+		lvs, e := ins.opts.labelValues(req.URL.Host, strings.ToLower(req.Method), code, reason), ins.opts.exemplar(req.Context())
+		if requestDuration != nil {
+			observeWithExemplar(requestDuration.WithLabelValues(lvs...), time.Since(now).Seconds(), e)
+		}
+		if requestsTotal != nil {
+			incWithExemplar(requestsTotal.WithLabelValues(lvs...), e)
+		}
+		return resp, err
+	})
+
+	if ins.opts.enabled(MetricClientRequestsInFlight) {
+		base = promhttp.InstrumentRoundTripperInFlight(
+			promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Namespace: ins.opts.namespace,
+					Name:      MetricClientRequestsInFlight,
+					Help:      "Tracks the number of HTTP requests currently in flight.",
+				},
+			),
+			base,
+		)
+	}
 	if ins.tp != nil {
 		return otelhttp.NewTransport(base, otelhttp.WithTracerProvider(ins.tp), otelhttp.WithPropagators(ins.tp))
 	}
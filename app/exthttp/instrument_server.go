@@ -6,7 +6,6 @@
 package exthttp
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -16,7 +15,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel/trace"
 )
 
 // InstrumentationMiddleware holds necessary metrics to instrument an http.Server
@@ -40,91 +38,133 @@ func NewNopInstrumentationMiddleware() InstrumentationMiddleware {
 }
 
 type instrumentationMiddleware struct {
-	reg     prometheus.Registerer
-	tp      *tracing.Provider
-	buckets []float64
+	reg  prometheus.Registerer
+	tp   *tracing.Provider
+	opts instrumentationOptions
 }
 
 // NewInstrumentationMiddleware provides default InstrumentationMiddleware.
-// Passing nil as buckets uses the default buckets.
-func NewInstrumentationMiddleware(reg prometheus.Registerer, buckets []float64, tp *tracing.Provider) InstrumentationMiddleware {
-	if buckets == nil {
-		buckets = []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120, 240, 360, 720}
-	}
-
-	return &instrumentationMiddleware{reg: reg, buckets: buckets, tp: tp}
+// If tp is not nil, requests are also traced.
+func NewInstrumentationMiddleware(reg prometheus.Registerer, tp *tracing.Provider, opts ...InstrumentationOption) InstrumentationMiddleware {
+	return &instrumentationMiddleware{reg: reg, tp: tp, opts: newInstrumentationOptions(opts)}
 }
 
 // WrapHandler wraps the given HTTP handler for instrumentation. It
-// registers four metric collectors (if not already done) and reports HTTP
+// registers six metric collectors (if not already done and not disabled) and reports HTTP
 // metrics to the (newly or already) registered collectors: http_requests_total
 // (CounterVec), http_request_duration_seconds (Histogram),
-// http_request_size_bytes (Summary), http_response_size_bytes (Summary). Each
+// http_request_time_to_first_byte_seconds (Histogram),
+// http_request_size_bytes_histogram (Histogram), http_response_size_bytes_histogram
+// (Histogram) and http_requests_inflight (Gauge). Each
 // has a constant label named "handler" with the provided handlerName as
-// value. http_requests_total is a metric vector partitioned by HTTP method
-// (label name "method") and HTTP status code (label name "code").
+// value. All of them except the gauge are partitioned by HTTP method (label name "method") and
+// HTTP status code (label name "code"). If request is part of sampled trace,
+// trace ID is attached to every observation as exemplar.
 func (ins *instrumentationMiddleware) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
-	reg := prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, ins.reg)
-
-	requestDuration := promauto.With(reg).NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "Tracks the latencies for HTTP requests.",
-			Buckets: ins.buckets,
-		},
-		[]string{"method", "code"},
-	)
-	requestSize := promauto.With(reg).NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name: "http_request_size_bytes",
-			Help: "Tracks the size of HTTP requests.",
-		},
-		[]string{"method", "code"},
-	)
-	requestsTotal := promauto.With(reg).NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Tracks the number of HTTP requests.",
-		}, []string{"method", "code"},
-	)
-	responseSize := promauto.With(reg).NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name: "http_response_size_bytes",
-			Help: "Tracks the size of HTTP responses.",
-		},
-		[]string{"method", "code"},
-	)
-	// TODO(bwplotka): Add exemplars everywhere when supported: https://github.com/prometheus/client_golang/issues/854
-	base := promhttp.InstrumentHandlerRequestSize(
-		requestSize,
-		promhttp.InstrumentHandlerCounter(
-			requestsTotal,
-			promhttp.InstrumentHandlerResponseSize(
-				responseSize,
-				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					now := time.Now()
-
-					wd := &responseWriterDelegator{w: w}
-					handler.ServeHTTP(wd, r)
-
-					observer := requestDuration.WithLabelValues(strings.ToLower(r.Method), wd.Status())
-					// If we find a TraceID from OpenTelemetry we'll expose it as Exemplar.
-					if spanCtx := trace.SpanContextFromContext(r.Context()); spanCtx.HasTraceID() && spanCtx.IsSampled() {
-						traceID := prometheus.Labels{"traceID": spanCtx.TraceID().String()}
-
-						observer.(prometheus.ExemplarObserver).ObserveWithExemplar(time.Since(now).Seconds(), traceID)
-						return
-					}
-
-					observer.Observe(time.Since(now).Seconds())
-					return
-
-				}),
-			),
-		),
+	var (
+		reg        = ins.opts.registerer(ins.reg, "handler", handlerName)
+		labelNames = ins.opts.labelNames("method", "code")
+
+		requestDuration, timeToFirstByte, requestSize, responseSize *prometheus.HistogramVec
+		requestsTotal                                               *prometheus.CounterVec
 	)
+	if ins.opts.enabled(MetricRequestDuration) {
+		requestDuration = promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricRequestDuration,
+				Help:      "Tracks the latencies for HTTP requests.",
+				Buckets:   ins.opts.bucketsFor(handlerName),
+			},
+			labelNames,
+		)
+	}
+	if ins.opts.enabled(MetricTimeToFirstByte) {
+		timeToFirstByte = promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricTimeToFirstByte,
+				Help:      "Tracks the time from receiving HTTP request until the response status code and headers were written.",
+				Buckets:   ins.opts.bucketsFor(handlerName),
+			},
+			labelNames,
+		)
+	}
+	// Sizes are histograms and not summaries, because only histograms support exemplars.
+	if ins.opts.enabled(MetricRequestSize) {
+		requestSize = promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricRequestSize,
+				Help:      "Tracks the size of HTTP requests.",
+				Buckets:   prometheus.ExponentialBuckets(64, 4, 9),
+			},
+			labelNames,
+		)
+	}
+	if ins.opts.enabled(MetricRequestsTotal) {
+		requestsTotal = promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricRequestsTotal,
+				Help:      "Tracks the number of HTTP requests.",
+			}, labelNames,
+		)
+	}
+	if ins.opts.enabled(MetricResponseSize) {
+		responseSize = promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ins.opts.namespace,
+				Name:      MetricResponseSize,
+				Help:      "Tracks the size of HTTP responses.",
+				Buckets:   prometheus.ExponentialBuckets(64, 4, 9),
+			},
+			labelNames,
+		)
+	}
 
-	if ins.tp != nil {
+	var base http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		wd := newResponseWriterDelegator(w)
+		handler.ServeHTTP(wd.wrapped(), r)
+
+		lvs, e := ins.opts.labelValues(r.Host, strings.ToLower(r.Method), wd.Status()), ins.opts.exemplar(r.Context())
+		if requestDuration != nil {
+			observeWithExemplar(requestDuration.WithLabelValues(lvs...), time.Since(now).Seconds(), e)
+		}
+		if timeToFirstByte != nil {
+			// If handler didn't write anything, headers go out right after it returns.
+			firstByte := wd.FirstByte()
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+			}
+			observeWithExemplar(timeToFirstByte.WithLabelValues(lvs...), firstByte.Sub(now).Seconds(), e)
+		}
+		if requestSize != nil {
+			observeWithExemplar(requestSize.WithLabelValues(lvs...), float64(approximateRequestSize(r)), e)
+		}
+		if responseSize != nil {
+			observeWithExemplar(responseSize.WithLabelValues(lvs...), float64(wd.BytesWritten()), e)
+		}
+		if requestsTotal != nil {
+			incWithExemplar(requestsTotal.WithLabelValues(lvs...), e)
+		}
+	})
+
+	if ins.opts.enabled(MetricRequestsInFlight) {
+		base = promhttp.InstrumentHandlerInFlight(
+			promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Namespace: ins.opts.namespace,
+					Name:      MetricRequestsInFlight,
+					Help:      "Tracks the number of HTTP requests currently being served.",
+				},
+			),
+			base,
+		)
+	}
+	if _, untraced := ins.opts.untraced[handlerName]; ins.tp != nil && !untraced {
 		return otelhttp.NewHandler(
 			base,
 			handlerName,
@@ -135,34 +175,25 @@ func (ins *instrumentationMiddleware) WrapHandler(handlerName string, handler ht
 	return base.ServeHTTP
 }
 
-// responseWriterDelegator implements http.ResponseWriter and extracts the statusCode.
-type responseWriterDelegator struct {
-	w          http.ResponseWriter
-	written    bool
-	statusCode int
-}
-
-func (wd *responseWriterDelegator) Header() http.Header {
-	return wd.w.Header()
-}
-
-func (wd *responseWriterDelegator) Write(bytes []byte) (int, error) {
-	return wd.w.Write(bytes)
-}
-
-func (wd *responseWriterDelegator) WriteHeader(statusCode int) {
-	wd.written = true
-	wd.statusCode = statusCode
-	wd.w.WriteHeader(statusCode)
-}
-
-func (wd *responseWriterDelegator) StatusCode() int {
-	if !wd.written {
-		return http.StatusOK
+// approximateRequestSize returns the size of request in bytes, same as promhttp.InstrumentHandlerRequestSize does.
+func approximateRequestSize(r *http.Request) int {
+	s := 0
+	if r.URL != nil {
+		s += len(r.URL.String())
 	}
-	return wd.statusCode
-}
+	s += len(r.Method)
+	s += len(r.Proto)
+	for name, values := range r.Header {
+		s += len(name)
+		for _, value := range values {
+			s += len(value)
+		}
+	}
+	s += len(r.Host)
 
-func (wd *responseWriterDelegator) Status() string {
-	return fmt.Sprintf("%d", wd.StatusCode())
+	// N.B. r.Form and r.MultipartForm are assumed to be included in r.URL.
+	if r.ContentLength != -1 {
+		s += int(r.ContentLength)
+	}
+	return s
 }
@@ -0,0 +1,152 @@
+package exthttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exportedGauge returns value of the only series of the given gauge and false if gauge is not exported.
+func exportedGauge(t *testing.T, reg *prometheus.Registry, name string) (float64, bool) {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			testutil.Equals(t, 1, len(mf.GetMetric()))
+			return mf.GetMetric()[0].GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+// exportedHistogram returns sample count, sum and labels of the only series of the given histogram.
+func exportedHistogram(t *testing.T, reg *prometheus.Registry, name string) (uint64, float64, map[string]string) {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		testutil.Equals(t, 1, len(mf.GetMetric()))
+		m := mf.GetMetric()[0]
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), labels
+	}
+	t.Fatalf("histogram %v not exported", name)
+	return 0, 0, nil
+}
+
+func TestInstrumentationMiddleware_InFlight(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		opts []InstrumentationOption
+
+		expGauge bool
+	}{
+		{name: "enabled by default", expGauge: true},
+		{name: "disabled", opts: []InstrumentationOption{WithoutMetrics(MetricRequestsInFlight)}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var (
+				reg      = prometheus.NewRegistry()
+				started  = make(chan struct{})
+				finish   = make(chan struct{})
+				finished = make(chan struct{})
+			)
+			h := NewInstrumentationMiddleware(reg, nil, tcase.opts...).WrapHandler("/ping", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				close(started)
+				<-finish
+			}))
+
+			go func() {
+				defer close(finished)
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+			}()
+			<-started
+
+			inFlight, ok := exportedGauge(t, reg, MetricRequestsInFlight)
+			testutil.Equals(t, tcase.expGauge, ok)
+			if ok {
+				testutil.Equals(t, 1.0, inFlight)
+			}
+
+			close(finish)
+			<-finished
+			inFlight, ok = exportedGauge(t, reg, MetricRequestsInFlight)
+			testutil.Equals(t, tcase.expGauge, ok)
+			testutil.Equals(t, 0.0, inFlight)
+		})
+	}
+}
+
+func TestInstrumentationMiddleware_TimeToFirstByte(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	for _, tcase := range []struct {
+		name    string
+		handler http.HandlerFunc
+
+		expCode string
+		// expAfterFirstByte is true if handler keeps working after the first byte.
+		expAfterFirstByte bool
+	}{
+		{
+			name: "WriteHeader",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				time.Sleep(delay)
+				w.WriteHeader(http.StatusAccepted)
+				time.Sleep(2 * delay)
+			},
+			expCode:           "202",
+			expAfterFirstByte: true,
+		},
+		{
+			name: "Write",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				time.Sleep(delay)
+				_, _ = w.Write([]byte("pong"))
+				time.Sleep(2 * delay)
+				_, _ = w.Write([]byte("pong"))
+			},
+			expCode:           "200",
+			expAfterFirstByte: true,
+		},
+		{
+			name: "nothing written",
+			handler: func(http.ResponseWriter, *http.Request) {
+				time.Sleep(delay)
+			},
+			expCode: "200",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			h := NewInstrumentationMiddleware(reg, nil).WrapHandler("/ping", tcase.handler)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+			count, firstByte, labels := exportedHistogram(t, reg, MetricTimeToFirstByte)
+			testutil.Equals(t, uint64(1), count)
+			testutil.Equals(t, tcase.expCode, labels["code"])
+			testutil.Assert(t, firstByte >= delay.Seconds(), "time to first byte %v is shorter than delay", firstByte)
+
+			_, total, _ := exportedHistogram(t, reg, MetricRequestDuration)
+			if tcase.expAfterFirstByte {
+				testutil.Assert(t, total-firstByte >= 2*delay.Seconds(), "time to first byte %v includes work after it, total %v", firstByte, total)
+				return
+			}
+			// Headers go out right after the handler returned.
+			testutil.Assert(t, firstByte >= total, "time to first byte %v is before the handler returned, total %v", firstByte, total)
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package exthttp
+
+import (
+	"net/http"
+)
+
+// Middleware wraps an http.Handler with additional behavior.
+// Middlewares are meant to be chained, e.g. InstrumentationMiddleware on top of DeadlineMiddleware, so the
+// order defines what each of them observes.
+type Middleware interface {
+	// WrapHandler wraps the given HTTP handler.
+	WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc
+}
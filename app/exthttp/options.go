@@ -0,0 +1,265 @@
+package exthttp
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names (without namespace) of metrics exported by InstrumentationMiddleware and InstrumentationTripperware,
+// that can be disabled with WithoutMetrics. Size histograms have "_histogram" suffix, as names without it were
+// used by summaries before.
+const (
+	MetricRequestsTotal    = "http_requests_total"
+	MetricRequestDuration  = "http_request_duration_seconds"
+	MetricTimeToFirstByte  = "http_request_time_to_first_byte_seconds"
+	MetricRequestSize      = "http_request_size_bytes_histogram"
+	MetricResponseSize     = "http_response_size_bytes_histogram"
+	MetricRequestsInFlight = "http_requests_inflight"
+
+	MetricClientRequestsTotal    = "http_client_requests_total"
+	MetricClientRequestDuration  = "http_client_request_duration_seconds"
+	MetricClientRequestsInFlight = "http_client_requests_inflight"
+	MetricClientPhaseDuration    = "http_client_request_phase_duration_seconds"
+)
+
+// OtherLabelValue is the value of dynamic labels that exceeded cardinality limit.
+const OtherLabelValue = "other"
+
+// InstrumentationOption sets the value of an option for InstrumentationMiddleware and InstrumentationTripperware.
+// Options that make sense only for one of them are ignored by the other.
+type InstrumentationOption func(*instrumentationOptions)
+
+type instrumentationOptions struct {
+	namespace      string
+	constLabels    prometheus.Labels
+	buckets        []float64
+	nameBuckets    map[string][]float64
+	disabled       map[string]struct{}
+	hostLabel      *hostLabeler
+	exemplarSpanID bool
+	exemplarLabels prometheus.Labels
+	phaseBuckets   []float64
+	untraced       map[string]struct{}
+}
+
+func newInstrumentationOptions(opts []InstrumentationOption) instrumentationOptions {
+	o := instrumentationOptions{
+		buckets:     []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120, 240, 360, 720},
+		nameBuckets: map[string][]float64{},
+		disabled:    map[string]struct{}{},
+		untraced:    map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithNamespace prefixes names of all metrics with the given namespace, e.g "myteam" gives "myteam_http_requests_total".
+func WithNamespace(namespace string) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.namespace = namespace
+	}
+}
+
+// WithConstLabels adds given constant labels to all metrics.
+func WithConstLabels(labels prometheus.Labels) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.constLabels = labels
+	}
+}
+
+// WithBuckets sets buckets of request duration histograms.
+func WithBuckets(buckets []float64) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.buckets = buckets
+	}
+}
+
+// WithNameBuckets overrides buckets of request duration histogram for the given handler (middleware) or target
+// (tripperware) name, e.g for slow handlers.
+func WithNameBuckets(name string, buckets []float64) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.nameBuckets[name] = buckets
+	}
+}
+
+// WithoutMetrics disables metrics with given names (without namespace), e.g MetricRequestSize.
+func WithoutMetrics(names ...string) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		for _, n := range names {
+			o.disabled[n] = struct{}{}
+		}
+	}
+}
+
+// WithHostLabel adds "host" label with the host of the request to request metrics, e.g when single client talks to
+// many instances. Known hosts are always kept. Other hosts are kept until there are maxHosts distinct values, then
+// they are folded into "other", so cardinality stays bounded.
+func WithHostLabel(maxHosts int, known ...string) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.hostLabel = newHostLabeler(maxHosts, known)
+	}
+}
+
+// WithExemplarSpanID adds "spanID" label to exemplars, next to "traceID". All exemplar labels together can't be
+// longer than prometheus.ExemplarMaxRunes, labels that don't fit are skipped.
+func WithExemplarSpanID() InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.exemplarSpanID = true
+	}
+}
+
+// WithExemplarLabels adds given constant labels (e.g app version) to exemplars. Keep them short, as all exemplar
+// labels together can't be longer than prometheus.ExemplarMaxRunes, labels that don't fit are skipped.
+func WithExemplarLabels(labels prometheus.Labels) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		o.exemplarLabels = labels
+	}
+}
+
+// WithPhaseMetrics enables tracking of round trip phases (DNS, connect, TLS, time to first byte and body transfer)
+// using httptrace. Phases are exported as http_client_request_phase_duration_seconds histogram with given buckets
+// and added as events to the request span. Passing nil as buckets uses the default buckets. Tripperware only.
+func WithPhaseMetrics(buckets []float64) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		if buckets == nil {
+			buckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+		}
+		o.phaseBuckets = buckets
+	}
+}
+
+// WithoutTracing disables tracing of requests to given handlers, e.g "/metrics" scraped every few seconds.
+// Middleware only.
+func WithoutTracing(handlerNames ...string) InstrumentationOption {
+	return func(o *instrumentationOptions) {
+		for _, n := range handlerNames {
+			o.untraced[n] = struct{}{}
+		}
+	}
+}
+
+func (o instrumentationOptions) enabled(metric string) bool {
+	_, ok := o.disabled[metric]
+	return !ok
+}
+
+func (o instrumentationOptions) bucketsFor(name string) []float64 {
+	if b, ok := o.nameBuckets[name]; ok {
+		return b
+	}
+	return o.buckets
+}
+
+// registerer returns registerer adding const labels and the given name label to all metrics.
+func (o instrumentationOptions) registerer(reg prometheus.Registerer, nameLabel, name string) prometheus.Registerer {
+	labels := prometheus.Labels{nameLabel: name}
+	for k, v := range o.constLabels {
+		labels[k] = v
+	}
+	return prometheus.WrapRegistererWith(labels, reg)
+}
+
+// labelNames returns names of variable labels of request metrics.
+func (o instrumentationOptions) labelNames(names ...string) []string {
+	if o.hostLabel != nil {
+		names = append(names, "host")
+	}
+	return names
+}
+
+// labelValues returns values of variable labels of request metrics, matching labelNames.
+func (o instrumentationOptions) labelValues(host string, values ...string) []string {
+	if o.hostLabel != nil {
+		values = append(values, o.hostLabel.value(host))
+	}
+	return values
+}
+
+// exemplar returns exemplar labels for the context or nil if it's not part of sampled trace.
+func (o instrumentationOptions) exemplar(ctx context.Context) prometheus.Labels {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.HasTraceID() || !spanCtx.IsSampled() {
+		return nil
+	}
+
+	e := prometheus.Labels{"traceID": spanCtx.TraceID().String()}
+	runes := utf8.RuneCountInString("traceID") + utf8.RuneCountInString(e["traceID"])
+	add := func(k, v string) {
+		// Exemplar with too long labels is rejected with panic, so labels that don't fit are skipped.
+		if n := utf8.RuneCountInString(k) + utf8.RuneCountInString(v); runes+n <= prometheus.ExemplarMaxRunes {
+			e[k] = v
+			runes += n
+		}
+	}
+	if o.exemplarSpanID {
+		add("spanID", spanCtx.SpanID().String())
+	}
+	keys := make([]string, 0, len(o.exemplarLabels))
+	for k := range o.exemplarLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(k, o.exemplarLabels[k])
+	}
+	return e
+}
+
+// observeWithExemplar observes value with exemplar if not nil.
+func observeWithExemplar(o prometheus.Observer, v float64, e prometheus.Labels) {
+	if e != nil {
+		o.(prometheus.ExemplarObserver).ObserveWithExemplar(v, e)
+		return
+	}
+	o.Observe(v)
+}
+
+// incWithExemplar increments counter with exemplar if not nil.
+func incWithExemplar(c prometheus.Counter, e prometheus.Labels) {
+	if e != nil {
+		c.(prometheus.ExemplarAdder).AddWithExemplar(1, e)
+		return
+	}
+	c.Inc()
+}
+
+// hostLabeler bounds cardinality of host label.
+type hostLabeler struct {
+	max int
+
+	mu    sync.Mutex
+	known map[string]struct{}
+	seen  map[string]struct{}
+}
+
+func newHostLabeler(max int, known []string) *hostLabeler {
+	h := &hostLabeler{max: max, known: map[string]struct{}{}, seen: map[string]struct{}{}}
+	for _, k := range known {
+		h.known[k] = struct{}{}
+	}
+	return h
+}
+
+func (h *hostLabeler) value(host string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.known[host]; ok {
+		return host
+	}
+	if _, ok := h.seen[host]; ok {
+		return host
+	}
+	if len(h.seen) < h.max {
+		h.seen[host] = struct{}{}
+		return host
+	}
+	return OtherLabelValue
+}
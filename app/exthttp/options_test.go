@@ -0,0 +1,85 @@
+package exthttp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestHostLabeler(t *testing.T) {
+	h := newHostLabeler(2, []string{"known:80"})
+
+	testutil.Equals(t, "a:80", h.value("a:80"))
+	testutil.Equals(t, "known:80", h.value("known:80"))
+	testutil.Equals(t, "b:80", h.value("b:80"))
+
+	// Limit is reached, new hosts are folded.
+	testutil.Equals(t, OtherLabelValue, h.value("c:80"))
+	testutil.Equals(t, OtherLabelValue, h.value("d:80"))
+
+	// Already seen and known hosts are kept.
+	testutil.Equals(t, "a:80", h.value("a:80"))
+	testutil.Equals(t, "b:80", h.value("b:80"))
+	testutil.Equals(t, "known:80", h.value("known:80"))
+}
+
+func TestInstrumentationOptions_Exemplar(t *testing.T) {
+	ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample())).Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+	traceID, spanID := span.SpanContext().TraceID().String(), span.SpanContext().SpanID().String()
+
+	unsampledCtx, unsampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())).Tracer("test").Start(context.Background(), "test")
+	defer unsampled.End()
+
+	for _, tcase := range []struct {
+		name string
+		opts []InstrumentationOption
+		ctx  context.Context
+
+		expExemplar prometheus.Labels
+	}{
+		{name: "no trace", ctx: context.Background()},
+		{name: "not sampled", ctx: unsampledCtx},
+		{name: "trace ID", ctx: ctx, expExemplar: prometheus.Labels{"traceID": traceID}},
+		{
+			name:        "span ID and labels",
+			opts:        []InstrumentationOption{WithExemplarSpanID(), WithExemplarLabels(prometheus.Labels{"v": "1"})},
+			ctx:         ctx,
+			expExemplar: prometheus.Labels{"traceID": traceID, "spanID": spanID, "v": "1"},
+		},
+		{
+			name:        "labels that don't fit are skipped",
+			opts:        []InstrumentationOption{WithExemplarSpanID(), WithExemplarLabels(prometheus.Labels{"version": "v1.0.0", "v": "1"})},
+			ctx:         ctx,
+			expExemplar: prometheus.Labels{"traceID": traceID, "spanID": spanID, "v": "1"},
+		},
+		{
+			name:        "smaller labels fit after skipped one",
+			opts:        []InstrumentationOption{WithExemplarLabels(prometheus.Labels{"a": strings.Repeat("x", 30), "b": "1"})},
+			ctx:         ctx,
+			expExemplar: prometheus.Labels{"traceID": traceID, "b": "1"},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			e := newInstrumentationOptions(tcase.opts).exemplar(tcase.ctx)
+			testutil.Equals(t, tcase.expExemplar, e)
+
+			runes := 0
+			for k, v := range e {
+				runes += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+			}
+			testutil.Assert(t, runes <= prometheus.ExemplarMaxRunes, "exemplar has %v runes", runes)
+
+			// Exemplar has to be accepted by the client library, which panics otherwise.
+			h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"})
+			c := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total"})
+			observeWithExemplar(h, 1, e)
+			incWithExemplar(c, e)
+		})
+	}
+}
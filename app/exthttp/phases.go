@@ -0,0 +1,125 @@
+package exthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Phases of HTTP round trip, used as "phase" label.
+const (
+	phaseDNS      = "dns"
+	phaseConnect  = "connect"
+	phaseTLS      = "tls"
+	phaseTTFB     = "ttfb"
+	phaseTransfer = "transfer"
+)
+
+// phaseMetrics tracks duration of round trip phases using httptrace.
+type phaseMetrics struct {
+	durations *prometheus.HistogramVec
+	opts      instrumentationOptions
+}
+
+func newPhaseMetrics(reg prometheus.Registerer, opts instrumentationOptions) *phaseMetrics {
+	return &phaseMetrics{
+		opts: opts,
+		durations: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.namespace,
+			Name:      MetricClientPhaseDuration,
+			Help: "Tracks the latencies of HTTP request phases: dns, connect, tls, ttfb (from request written to " +
+				"the first response byte) and transfer (response body read). Phases skipped thanks to connection reuse are not observed.",
+			Buckets: opts.phaseBuckets,
+		}, []string{"phase"}),
+	}
+}
+
+// phaseTracker collects phase timings of a single round trip. Callbacks of httptrace can be called concurrently
+// (e.g connecting to multiple addresses), so it's guarded by mutex.
+type phaseTracker struct {
+	m    *phaseMetrics
+	ctx  context.Context
+	span trace.Span
+
+	mu                                             sync.Mutex
+	dnsStart, connectStart, tlsStart, wroteRequest time.Time
+}
+
+func (p *phaseTracker) observe(phase string, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	d := time.Since(start)
+
+	p.span.AddEvent(phase+" done", trace.WithAttributes(attribute.Float64("duration_seconds", d.Seconds())))
+	observeWithExemplar(p.m.durations.WithLabelValues(phase), d.Seconds(), p.m.opts.exemplar(p.ctx))
+}
+
+func (p *phaseTracker) clientTrace() *httptrace.ClientTrace {
+	start := func(t *time.Time) {
+		p.mu.Lock()
+		*t = time.Now()
+		p.mu.Unlock()
+	}
+	done := func(phase string, t *time.Time) {
+		p.mu.Lock()
+		s := *t
+		p.mu.Unlock()
+		p.observe(phase, s)
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { start(&p.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { done(phaseDNS, &p.dnsStart) },
+		ConnectStart:      func(string, string) { start(&p.connectStart) },
+		ConnectDone:       func(string, string, error) { done(phaseConnect, &p.connectStart) },
+		TLSHandshakeStart: func() { start(&p.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { done(phaseTLS, &p.tlsStart) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { start(&p.wroteRequest) },
+		GotFirstResponseByte: func() {
+			done(phaseTTFB, &p.wroteRequest)
+		},
+	}
+}
+
+// roundTrip does the round trip with phase tracking. Transfer phase is observed once response body is fully read or closed.
+func (m *phaseMetrics) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	p := &phaseTracker{m: m, ctx: req.Context(), span: trace.SpanFromContext(req.Context())}
+	resp, err := next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), p.clientTrace())))
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	// Response headers are read at this point, so the rest is body transfer.
+	transferStart := time.Now()
+	resp.Body = &transferTrackingBody{ReadCloser: resp.Body, done: func() { p.observe(phaseTransfer, transferStart) }}
+	return resp, nil
+}
+
+// transferTrackingBody calls done once, when body was read till the end or closed.
+type transferTrackingBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *transferTrackingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *transferTrackingBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
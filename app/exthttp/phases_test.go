@@ -0,0 +1,102 @@
+package exthttp
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exportedPhases returns the number of observations of every phase exported by phase metrics.
+func exportedPhases(t *testing.T, reg *prometheus.Registry) map[string]int {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	ret := map[string]int{}
+	for _, mf := range mfs {
+		if mf.GetName() != "http_client_request_phase_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "phase" {
+					ret[l.GetValue()] = int(m.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func TestPhaseMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	})
+
+	for _, tcase := range []struct {
+		name     string
+		tls      bool
+		requests int
+		// readBody reads the body till the end before closing it.
+		readBody bool
+
+		expPhases map[string]int
+	}{
+		{
+			name:      "new connection",
+			requests:  1,
+			readBody:  true,
+			expPhases: map[string]int{phaseConnect: 1, phaseTTFB: 1, phaseTransfer: 1},
+		},
+		{
+			name:      "new TLS connection",
+			tls:       true,
+			requests:  1,
+			readBody:  true,
+			expPhases: map[string]int{phaseConnect: 1, phaseTLS: 1, phaseTTFB: 1, phaseTransfer: 1},
+		},
+		{
+			name:      "reused connection skips connect and TLS",
+			tls:       true,
+			requests:  3,
+			readBody:  true,
+			expPhases: map[string]int{phaseConnect: 1, phaseTLS: 1, phaseTTFB: 3, phaseTransfer: 3},
+		},
+		{
+			name:      "transfer is observed once body is closed without reading",
+			requests:  1,
+			expPhases: map[string]int{phaseConnect: 1, phaseTTFB: 1, phaseTransfer: 1},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(handler)
+			if tcase.tls {
+				srv.StartTLS()
+			} else {
+				srv.Start()
+			}
+			defer srv.Close()
+
+			reg := prometheus.NewRegistry()
+			client := &http.Client{
+				Transport: NewInstrumentationTripperware(reg, nil, WithPhaseMetrics(nil)).WrapRoundTripper("app", srv.Client().Transport),
+			}
+			for i := 0; i < tcase.requests; i++ {
+				resp, err := client.Get(srv.URL)
+				testutil.Ok(t, err)
+				if tcase.readBody {
+					_, err = io.Copy(ioutil.Discard, resp.Body)
+					testutil.Ok(t, err)
+				}
+				testutil.Ok(t, resp.Body.Close())
+			}
+
+			testutil.Equals(t, tcase.expPhases, exportedPhases(t, reg))
+		})
+	}
+}
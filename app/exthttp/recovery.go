@@ -0,0 +1,84 @@
+package exthttp
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type recoveryMiddleware struct {
+	reg    prometheus.Registerer
+	logger *log.Logger
+}
+
+// NewRecoveryMiddleware provides Middleware that recovers from handler panics and responds with 500, unless the
+// response was already started. Panics are counted in http_handler_panics_total, logged with the stack trace using
+// logger (standard logger if nil) and recorded as an error event with the stack trace on the request span, which
+// gets error status. When wrapped by InstrumentationMiddleware, recovered requests are observed with 500 code.
+// http.ErrAbortHandler panics are passed through, as they are used to abort the response on purpose.
+func NewRecoveryMiddleware(reg prometheus.Registerer, logger *log.Logger) Middleware {
+	return &recoveryMiddleware{reg: reg, logger: logger}
+}
+
+func (m *recoveryMiddleware) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, m.reg)
+	panics := promauto.With(reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_handler_panics_total",
+			Help: "Tracks the number of HTTP requests that panicked in the handler.",
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		wd := newResponseWriterDelegator(w)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			stack := string(debug.Stack())
+			if hp, ok := p.(*handlerPanic); ok {
+				// Panic from handler run in another goroutine, e.g by TimeoutMiddleware.
+				p, stack = hp.value, string(hp.stack)
+			}
+			err := errors.Errorf("panic: %v", p)
+			panics.Inc()
+
+			span := trace.SpanFromContext(r.Context())
+			span.RecordError(err, trace.WithAttributes(attribute.String("exception.stacktrace", stack)))
+			span.SetStatus(codes.Error, err.Error())
+
+			m.logf("handler %v %v %v: %v\n%s", handlerName, r.Method, r.URL, err, stack)
+
+			if !wd.FirstByte().IsZero() {
+				// Status code is already sent, nothing else can be done.
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintln(w, "internal server error")
+		}()
+		handler.ServeHTTP(wd.wrapped(), r)
+	}
+}
+
+func (m *recoveryMiddleware) logf(format string, args ...interface{}) {
+	if m.logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	m.logger.Printf(format, args...)
+}
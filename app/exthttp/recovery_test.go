@@ -0,0 +1,134 @@
+package exthttp
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// endedSpans records spans once they end.
+type endedSpans struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *endedSpans) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (e *endedSpans) OnEnd(s sdktrace.ReadOnlySpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func (e *endedSpans) Shutdown(context.Context) error   { return nil }
+func (e *endedSpans) ForceFlush(context.Context) error { return nil }
+
+func TestRecoveryMiddleware(t *testing.T) {
+	for _, tcase := range []struct {
+		name    string
+		handler http.HandlerFunc
+
+		expCode   int
+		expBody   string
+		expPanics float64
+	}{
+		{
+			name: "no panic",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("pong"))
+			},
+			expCode: http.StatusOK,
+			expBody: "pong",
+		},
+		{
+			name: "panic before response",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("X-App-Version", "first")
+				panic("boom")
+			},
+			expCode:   http.StatusInternalServerError,
+			expBody:   "internal server error\n",
+			expPanics: 1,
+		},
+		{
+			name: "panic after response started",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte("po"))
+				panic("boom")
+			},
+			expCode:   http.StatusAccepted,
+			expBody:   "po",
+			expPanics: 1,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var (
+				reg   = prometheus.NewRegistry()
+				logs  bytes.Buffer
+				ended = &endedSpans{}
+			)
+			ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(ended)).Tracer("test").Start(context.Background(), "request")
+
+			rec := httptest.NewRecorder()
+			NewRecoveryMiddleware(reg, log.New(&logs, "", 0)).WrapHandler("/ping", tcase.handler).
+				ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil).WithContext(ctx))
+			span.End()
+
+			testutil.Equals(t, tcase.expCode, rec.Code)
+			testutil.Equals(t, tcase.expBody, rec.Body.String())
+			testutil.Equals(t, tcase.expPanics, counterValue(t, reg, "http_handler_panics_total"))
+
+			testutil.Equals(t, 1, len(ended.spans))
+			if tcase.expPanics == 0 {
+				testutil.Equals(t, "", logs.String())
+				testutil.Equals(t, codes.Unset, ended.spans[0].StatusCode())
+				return
+			}
+			testutil.Assert(t, strings.HasPrefix(logs.String(), "handler /ping GET /ping: panic: boom\n"), "unexpected log %q", logs.String())
+			testutil.Assert(t, strings.Contains(logs.String(), "runtime/debug.Stack"), "log should contain stack trace")
+			testutil.Equals(t, codes.Error, ended.spans[0].StatusCode())
+			testutil.Equals(t, "panic: boom", ended.spans[0].StatusMessage())
+			testutil.Equals(t, 1, len(ended.spans[0].Events()))
+		})
+	}
+}
+
+func TestRecoveryMiddleware_AbortHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := NewRecoveryMiddleware(reg, log.New(&bytes.Buffer{}, "", 0)).WrapHandler("/ping", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		// Abort is passed through to the server, so it can drop the connection.
+		testutil.Equals(t, http.ErrAbortHandler, recover())
+		testutil.Equals(t, 0.0, counterValue(t, reg, "http_handler_panics_total"))
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+}
+
+// counterValue returns value of the only series of the given counter, or 0 if it is not exported.
+func counterValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			testutil.Equals(t, 1, len(mf.GetMetric()))
+			return mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
@@ -0,0 +1,308 @@
+package exthttp
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/tracing"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// RetryOption sets the value of an option for RetryTripperware.
+type RetryOption func(*retryOptions)
+
+type retryOptions struct {
+	maxAttempts    int
+	retryableCodes map[int]struct{}
+	retryableErr   func(error) bool
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	budgetRatio    float64
+	budgetBurst    float64
+}
+
+// WithRetryMaxAttempts sets maximum number of attempts per request, including the first one. Default is 3.
+func WithRetryMaxAttempts(n int) RetryOption {
+	return func(o *retryOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// WithRetryableCodes sets HTTP status codes that are retried. Default is 429, 502, 503 and 504.
+func WithRetryableCodes(codes ...int) RetryOption {
+	return func(o *retryOptions) {
+		o.retryableCodes = map[int]struct{}{}
+		for _, c := range codes {
+			o.retryableCodes[c] = struct{}{}
+		}
+	}
+}
+
+// WithRetryableErrors sets function deciding if failed round trip is retried.
+// Default retries refused and reset connections, see ClassifyError.
+func WithRetryableErrors(f func(error) bool) RetryOption {
+	return func(o *retryOptions) {
+		o.retryableErr = f
+	}
+}
+
+// WithRetryBackoff sets bounds of exponential backoff between attempts. Actual backoff is
+// chosen randomly between zero and the exponential value (full jitter). Retry-After sent by the server is
+// used instead, but capped at max too. Default is 25ms and 1s.
+func WithRetryBackoff(min, max time.Duration) RetryOption {
+	return func(o *retryOptions) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithRetryBudget limits retries to the given ratio of extra load, e.g 0.2 means at most 20% more requests than
+// without retries. Burst allows that many retries before any request was made, so low traffic can still be retried.
+// Budget is shared across all targets wrapped by the same RetryTripperware. Default is 0.2 ratio with burst of 10.
+func WithRetryBudget(ratio float64, burst int) RetryOption {
+	return func(o *retryOptions) {
+		o.budgetRatio = ratio
+		o.budgetBurst = float64(burst)
+	}
+}
+
+// DefaultRetryableError returns true for errors that mean the request most likely didn't reach the server.
+func DefaultRetryableError(err error) bool {
+	switch ClassifyError(err) {
+	case ReasonRefused, ReasonReset:
+		return true
+	}
+	return false
+}
+
+// retryBudget is a token bucket. Each request deposits ratio of token, each retry withdraws full one.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type retryTripperware struct {
+	reg    prometheus.Registerer
+	tp     *tracing.Provider
+	opts   retryOptions
+	budget *retryBudget
+}
+
+// NewRetryTripperware provides Tripperware that retries failed requests with exponential backoff,
+// respecting Retry-After header and retry budget. Each attempt is recorded as child span. Only requests
+// with idempotent methods and bodies that can be replayed (see http.Request.GetBody) are retried.
+// Tracing provider is used to propagate the attempt span, it can be nil.
+func NewRetryTripperware(reg prometheus.Registerer, tp *tracing.Provider, opts ...RetryOption) Tripperware {
+	o := retryOptions{
+		maxAttempts:  3,
+		retryableErr: DefaultRetryableError,
+		minBackoff:   25 * time.Millisecond,
+		maxBackoff:   1 * time.Second,
+		budgetRatio:  0.2,
+		budgetBurst:  10,
+	}
+	WithRetryableCodes(http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout)(&o)
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &retryTripperware{
+		reg:    reg,
+		tp:     tp,
+		opts:   o,
+		budget: &retryBudget{ratio: o.budgetRatio, max: o.budgetBurst, tokens: o.budgetBurst},
+	}
+}
+
+func (r *retryTripperware) WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": targetName}, r.reg)
+	attemptsTotal := promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_request_attempts_total",
+			Help: "Tracks the number of HTTP request attempts, including retries.",
+		}, []string{"method", "code", "reason"},
+	)
+	retriesTotal := promauto.With(reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_client_retries_total",
+			Help: "Tracks the number of HTTP request retries.",
+		},
+	)
+	budgetExhaustedTotal := promauto.With(reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_client_retry_budget_exhausted_total",
+			Help: "Tracks the number of HTTP request retries skipped because retry budget was exhausted.",
+		},
+	)
+
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		r.budget.deposit()
+
+		for attempt := 1; ; attempt++ {
+			resp, err := r.attempt(req, attempt, next)
+
+			code, reason := CodeAndReason(resp, err)
+			attemptsTotal.WithLabelValues(strings.ToLower(req.Method), code, reason).Inc()
+
+			if attempt >= r.opts.maxAttempts || !r.retryable(req, resp, err) {
+				return resp, err
+			}
+
+			delay := r.backoff(attempt, resp)
+			if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(delay).After(deadline) {
+				// There is no point to wait, the request would time out anyway.
+				return resp, err
+			}
+			if !r.budget.withdraw() {
+				budgetExhaustedTotal.Inc()
+				return resp, err
+			}
+			retriesTotal.Inc()
+
+			if resp != nil && resp.Body != nil {
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(delay):
+			}
+		}
+	})
+}
+
+func (r *retryTripperware) attempt(req *http.Request, attempt int, next http.RoundTripper) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "retryAttempt")
+	defer span.End()
+	span.SetAttributes(attribute.Int("attempt", attempt))
+
+	attemptReq := req.Clone(ctx)
+	if attempt > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+	if r.tp != nil {
+		r.tp.Inject(ctx, propagation.HeaderCarrier(attemptReq.Header))
+	}
+
+	resp, err := next.RoundTrip(attemptReq)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("reason", ClassifyError(err)))
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, err
+}
+
+func (r *retryTripperware) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// Body can't be replayed.
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	if err != nil {
+		var invalidErr *InvalidResponseError
+		if errors.As(err, &invalidErr) {
+			// Response was received, so it is retried based on its status code.
+			_, ok := r.opts.retryableCodes[invalidErr.StatusCode]
+			return ok
+		}
+		return r.opts.retryableErr(err)
+	}
+	_, ok := r.opts.retryableCodes[resp.StatusCode]
+	return ok
+}
+
+func (r *retryTripperware) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			// Capped, so server can't make us wait e.g for an hour without deadline.
+			if d > r.opts.maxBackoff {
+				d = r.opts.maxBackoff
+			}
+			return d
+		}
+	}
+
+	b := float64(r.opts.minBackoff) * math.Pow(2, float64(attempt-1))
+	if b > float64(r.opts.maxBackoff) {
+		b = float64(r.opts.maxBackoff)
+	}
+	// Full jitter, so retries from many clients don't come in waves.
+	return time.Duration(rand.Float64() * b)
+}
+
+// retryAfter parses Retry-After header value, which can be either number of seconds or HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	d := time.Until(t)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
@@ -0,0 +1,114 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{ratio: 0.5, max: 2, tokens: 2}
+
+	// Burst is available right away.
+	testutil.Equals(t, true, b.withdraw())
+	testutil.Equals(t, true, b.withdraw())
+	testutil.Equals(t, false, b.withdraw())
+
+	// Every request deposits ratio of the token.
+	b.deposit()
+	testutil.Equals(t, false, b.withdraw())
+	b.deposit()
+	testutil.Equals(t, true, b.withdraw())
+	testutil.Equals(t, false, b.withdraw())
+
+	// Tokens don't accumulate above max.
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	testutil.Equals(t, true, b.withdraw())
+	testutil.Equals(t, true, b.withdraw())
+	testutil.Equals(t, false, b.withdraw())
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tcase := range []struct {
+		name  string
+		value string
+
+		expOK       bool
+		expDuration time.Duration
+	}{
+		{name: "empty"},
+		{name: "seconds", value: "5", expOK: true, expDuration: 5 * time.Second},
+		{name: "zero", value: "0", expOK: true},
+		{name: "negative", value: "-1"},
+		{name: "garbage", value: "soon"},
+		{name: "date in the past", value: "Mon, 02 Jan 2006 15:04:05 GMT", expOK: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			d, ok := retryAfter(tcase.value)
+			testutil.Equals(t, tcase.expOK, ok)
+			testutil.Equals(t, tcase.expDuration, d)
+		})
+	}
+
+	t.Run("date in the future", func(t *testing.T) {
+		d, ok := retryAfter(time.Now().Add(1 * time.Hour).UTC().Format(http.TimeFormat))
+		testutil.Equals(t, true, ok)
+		testutil.Assert(t, d > 59*time.Minute && d <= 1*time.Hour, "unexpected duration %v", d)
+	})
+}
+
+func TestRetryTripperware_Backoff(t *testing.T) {
+	r := NewRetryTripperware(prometheus.NewRegistry(), nil, WithRetryBackoff(10*time.Millisecond, 100*time.Millisecond)).(*retryTripperware)
+
+	withRetryAfter := func(v string) *http.Response {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": []string{v}}}
+	}
+	testutil.Equals(t, time.Duration(0), r.backoff(1, withRetryAfter("0")))
+	testutil.Equals(t, time.Duration(0), r.backoff(1, withRetryAfter("Mon, 02 Jan 2006 15:04:05 GMT")))
+	// Server can't make us wait longer than max backoff.
+	testutil.Equals(t, 100*time.Millisecond, r.backoff(1, withRetryAfter("3600")))
+
+	// Exponential with full jitter, capped at max.
+	for attempt := 1; attempt < 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			b := r.backoff(attempt, nil)
+			limit := 10 * time.Millisecond << (attempt - 1)
+			if limit > 100*time.Millisecond {
+				limit = 100 * time.Millisecond
+			}
+			testutil.Assert(t, b >= 0 && b <= limit, "attempt %d: backoff %v above %v", attempt, b, limit)
+		}
+	}
+}
+
+func TestRetryTripperware_Retryable(t *testing.T) {
+	r := NewRetryTripperware(prometheus.NewRegistry(), nil, WithRetryableCodes(http.StatusServiceUnavailable)).(*retryTripperware)
+
+	for _, tcase := range []struct {
+		name string
+		resp *http.Response
+		err  error
+
+		exp bool
+	}{
+		{name: "retryable code", resp: &http.Response{StatusCode: http.StatusServiceUnavailable}, exp: true},
+		{name: "other code", resp: &http.Response{StatusCode: http.StatusInternalServerError}},
+		{name: "refused connection", err: urlErr(syscall.ECONNREFUSED), exp: true},
+		{name: "timeout", err: urlErr(context.DeadlineExceeded)},
+		{name: "invalid response with retryable code", err: &InvalidResponseError{StatusCode: http.StatusServiceUnavailable, Err: errors.New("unexpected status")}, exp: true},
+		{name: "invalid response with other code", err: &InvalidResponseError{StatusCode: http.StatusOK, Err: errors.New("body does not match")}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.exp, r.retryable(httptest.NewRequest(http.MethodGet, "http://app/ping", nil), tcase.resp, tcase.err))
+		})
+	}
+}
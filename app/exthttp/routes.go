@@ -0,0 +1,71 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// UnmatchedRoute is the handler name used for requests that don't match any route, so arbitrary paths can't
+// explode cardinality of "handler" label.
+const UnmatchedRoute = "unmatched"
+
+// Router is an HTTP handler that can tell which route pattern matches the request, e.g http.ServeMux.
+type Router interface {
+	http.Handler
+	// Handler returns the handler to use for the given request and its registered pattern. Pattern is empty
+	// if no route matched.
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+// InstrumentRoutes wraps the whole router with the given middleware, using matched route pattern as handler name.
+// Routes added to the router later are instrumented automatically. Requests not matching any route share
+// UnmatchedRoute handler name.
+func InstrumentRoutes(m Middleware, router Router) http.Handler {
+	return &routesInstrumentation{m: m, router: router, handlers: map[string]http.Handler{}}
+}
+
+type routesInstrumentation struct {
+	m      Middleware
+	router Router
+
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+}
+
+type matchedHandlerKey struct{}
+
+func (ri *routesInstrumentation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := ri.router.Handler(r)
+	if pattern == "" {
+		pattern = UnmatchedRoute
+	}
+	// Matched handler is passed down in context, so the router does not have to match the request again.
+	ri.handler(pattern).ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), matchedHandlerKey{}, h)))
+}
+
+// handler returns the matched handler wrapped for the given pattern. Wrapping registers metrics, so it's done only
+// once per pattern.
+func (ri *routesInstrumentation) handler(pattern string) http.Handler {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	h, ok := ri.handlers[pattern]
+	if !ok {
+		h = ri.m.WrapHandler(pattern, http.HandlerFunc(ri.serveMatched))
+		ri.handlers[pattern] = h
+	}
+	return h
+}
+
+// serveMatched serves the request with the handler matched by the router. The same pattern can match different
+// handlers, e.g redirects, so it can't be captured when wrapping. If middleware dropped the matched handler from
+// context, the router matches the request again.
+func (ri *routesInstrumentation) serveMatched(w http.ResponseWriter, r *http.Request) {
+	h, ok := r.Context().Value(matchedHandlerKey{}).(http.Handler)
+	if !ok {
+		ri.router.ServeHTTP(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,63 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+// handlerNames records handler names of served requests and optionally drops request context values.
+type handlerNames struct {
+	dropContext bool
+	served      []string
+}
+
+func (n *handlerNames) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n.served = append(n.served, handlerName)
+		if n.dropContext {
+			r = r.WithContext(context.Background())
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func TestInstrumentRoutes(t *testing.T) {
+	for _, tcase := range []struct {
+		name        string
+		dropContext bool
+	}{
+		{name: "matched handler from context"},
+		{name: "middleware dropped context", dropContext: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			m := http.NewServeMux()
+			m.HandleFunc("/ping", func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("pong")) })
+			m.HandleFunc("/users/", func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("user")) })
+
+			names := &handlerNames{dropContext: tcase.dropContext}
+			h := InstrumentRoutes(names, m)
+
+			for _, req := range []struct {
+				path string
+
+				expCode int
+				expBody string
+			}{
+				{path: "/ping", expCode: http.StatusOK, expBody: "pong"},
+				{path: "/users/1", expCode: http.StatusOK, expBody: "user"},
+				{path: "/users/2", expCode: http.StatusOK, expBody: "user"},
+				{path: "/missing", expCode: http.StatusNotFound, expBody: "404 page not found\n"},
+			} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, req.path, nil))
+				testutil.Equals(t, req.expCode, rec.Code)
+				testutil.Equals(t, req.expBody, rec.Body.String())
+			}
+			testutil.Equals(t, []string{"/ping", "/users/", "/users/", UnmatchedRoute}, names.served)
+		})
+	}
+}
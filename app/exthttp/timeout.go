@@ -0,0 +1,294 @@
+package exthttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TimeoutOption sets the value of an option for timeout Middleware.
+type TimeoutOption func(*timeoutOptions)
+
+type timeoutOptions struct {
+	handlerTimeouts map[string]time.Duration
+	statusCode      int
+}
+
+// WithHandlerTimeout overrides the timeout for the given handler name, e.g for slow handlers. Zero disables the
+// timeout for the handler.
+func WithHandlerTimeout(handlerName string, timeout time.Duration) TimeoutOption {
+	return func(o *timeoutOptions) {
+		o.handlerTimeouts[handlerName] = timeout
+	}
+}
+
+// WithTimeoutStatusCode sets the status code of timed out responses. Default is 503 (same as http.TimeoutHandler),
+// 504 is another common choice.
+func WithTimeoutStatusCode(code int) TimeoutOption {
+	return func(o *timeoutOptions) {
+		o.statusCode = code
+	}
+}
+
+type timeoutMiddleware struct {
+	reg     prometheus.Registerer
+	timeout time.Duration
+	opts    timeoutOptions
+}
+
+// NewTimeoutMiddleware provides Middleware that bounds how long handlers can take. Once the timeout passes, the request
+// context is cancelled and, unless the response was already started, the client gets 503 (see WithTimeoutStatusCode)
+// with the body explaining the timeout right away, without waiting for the handler. Later writes of the handler fail
+// with http.ErrHandlerTimeout. Timeouts are counted in http_handler_timeouts_total and recorded on the request span,
+// which gets error status. Unlike http.TimeoutHandler, responses are not buffered and optional interfaces of the
+// writer (e.g http.Flusher or http.Hijacker) are preserved, so streaming and websocket handlers keep working.
+func NewTimeoutMiddleware(reg prometheus.Registerer, timeout time.Duration, opts ...TimeoutOption) Middleware {
+	o := timeoutOptions{handlerTimeouts: map[string]time.Duration{}, statusCode: http.StatusServiceUnavailable}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &timeoutMiddleware{reg: reg, timeout: timeout, opts: o}
+}
+
+func (m *timeoutMiddleware) WrapHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	timeout, ok := m.opts.handlerTimeouts[handlerName]
+	if !ok {
+		timeout = m.timeout
+	}
+	if timeout <= 0 {
+		return handler.ServeHTTP
+	}
+
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, m.reg)
+	timeouts := promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_handler_timeouts_total",
+			Help: "Tracks the number of HTTP requests that reached the handler timeout. Responded is false if " +
+				"the response was already started, so the timeout status could not be sent.",
+		}, []string{"responded"},
+	)
+	body := fmt.Sprintf("handler %v timed out after %v\n", handlerName, timeout)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: http.Header{}, ctx: ctx, parent: r.Context()}
+		done := make(chan struct{})
+		// Buffered, so the handler goroutine does not leak if it panics after timeout. Such panic is lost.
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					if p == http.ErrAbortHandler {
+						panicked <- p
+						return
+					}
+					// Keep the stack of the handler, re-panicking in this goroutine would lose it.
+					panicked <- &handlerPanic{value: p, stack: debug.Stack()}
+				}
+			}()
+			handler.ServeHTTP(tw.wrapped(), r.WithContext(ctx))
+			close(done)
+		}()
+
+		// wait waits for the handler to finish, passing its panic to middlewares above (e.g RecoveryMiddleware).
+		wait := func() {
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+			}
+		}
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			if ctx.Err() == nil || r.Context().Err() != nil {
+				tw.finish()
+				return
+			}
+			// Handler gave up once the deadline passed, the timeout is responded same as if it was still running.
+		case <-ctx.Done():
+			if r.Context().Err() != nil {
+				// Client is gone (or server is shutting down), not a handler timeout.
+				wait()
+				tw.finish()
+				return
+			}
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.Bool("handler.timeout", true))
+		span.AddEvent("handler timed out", trace.WithAttributes(attribute.String("timeout", timeout.String())))
+		span.SetStatus(codes.Error, "handler timed out")
+
+		if !tw.timeout(m.opts.statusCode, body) {
+			// Response was already started, so handler still owns the writer.
+			timeouts.WithLabelValues("false").Inc()
+			wait()
+			return
+		}
+		timeouts.WithLabelValues("true").Inc()
+	}
+}
+
+// handlerPanic is the panic recovered in handler goroutine, re-panicked with the stack of that goroutine, so
+// RecoveryMiddleware can report where the handler actually panicked.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// String includes the original stack, for panics reaching net/http server, which logs only its own stack.
+func (p *handlerPanic) String() string {
+	return fmt.Sprintf("%v\n\nhandler goroutine stack:\n%s", p.value, p.stack)
+}
+
+// timeoutWriter passes writes to the underlying writer, until it times out. Handler has separate header map,
+// so it can keep modifying it after timeout without racing with the server.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+	// ctx is the handler context with the timeout, parent is the request context.
+	ctx, parent context.Context
+
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// wrapped returns the writer implementing the same optional interfaces as the underlying writer.
+func (tw *timeoutWriter) wrapped() http.ResponseWriter {
+	return pickDelegator[optionalInterfaces(tw.w)](tw)
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.start()
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return
+	}
+	tw.start()
+	tw.w.WriteHeader(statusCode)
+}
+
+// start copies handler headers to the underlying writer before the response is started. Has to be called under lock.
+func (tw *timeoutWriter) start() {
+	if tw.started {
+		return
+	}
+	tw.started = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+}
+
+// expired returns true if the handler can't use the writer anymore. Handler can notice the deadline before the
+// middleware responds, so response not started before the deadline is rejected too. Has to be called under lock.
+func (tw *timeoutWriter) expired() bool {
+	return tw.timedOut || (!tw.started && tw.ctx.Err() != nil && tw.parent.Err() == nil)
+}
+
+// finish makes headers of handler that wrote nothing visible to the server, which sends them once we return.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.start()
+}
+
+// timeout responds with the given status code and body and makes further writes fail. It returns false if the
+// response was already started.
+func (tw *timeoutWriter) timeout(statusCode int, body string) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.started {
+		return false
+	}
+	tw.timedOut = true
+	tw.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw.w.Header().Set("X-Content-Type-Options", "nosniff")
+	tw.w.WriteHeader(statusCode)
+	_, _ = fmt.Fprint(tw.w, body)
+	return true
+}
+
+//nolint:staticcheck // Deprecated, but still used by some handlers.
+func (tw *timeoutWriter) CloseNotify() <-chan bool {
+	return tw.w.(http.CloseNotifier).CloseNotify()
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return
+	}
+	tw.start()
+	tw.w.(http.Flusher).Flush()
+}
+
+// Hijack hands the connection over to the handler, unless it already timed out. Hijacked connection counts as
+// started response, so timeout only cancels the context and waits for the handler.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	tw.started = true
+	return tw.w.(http.Hijacker).Hijack()
+}
+
+func (tw *timeoutWriter) ReadFrom(r io.Reader) (int64, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.start()
+	return tw.w.(io.ReaderFrom).ReadFrom(r)
+}
+
+// Push does not start the response, so it's possible only until timeout.
+func (tw *timeoutWriter) Push(target string, opts *http.PushOptions) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return http.ErrHandlerTimeout
+	}
+	return tw.w.(http.Pusher).Push(target, opts)
+}
@@ -0,0 +1,75 @@
+package exthttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	t.Run("optional interfaces are preserved", func(t *testing.T) {
+		for id, inner := range innerWriters {
+			var got int
+			h := NewTimeoutMiddleware(prometheus.NewRegistry(), time.Minute).WrapHandler("/", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				got = optionalInterfaces(w)
+			}))
+			h(inner(newFakeWriter()), httptest.NewRequest(http.MethodGet, "/", nil))
+			testutil.Equals(t, id, got)
+		}
+	})
+	t.Run("timeout before response", func(t *testing.T) {
+		lateWrite := make(chan error, 1)
+		h := NewTimeoutMiddleware(prometheus.NewRegistry(), 10*time.Millisecond).WrapHandler("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusGatewayTimeout)
+			_, err := w.Write([]byte("late"))
+			lateWrite <- err
+		}))
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusServiceUnavailable, resp.StatusCode)
+		testutil.Equals(t, "handler /ping timed out after 10ms\n", string(b))
+		testutil.Equals(t, http.ErrHandlerTimeout, <-lateWrite)
+	})
+	t.Run("streamed response is not replaced", func(t *testing.T) {
+		h := NewTimeoutMiddleware(prometheus.NewRegistry(), 10*time.Millisecond).WrapHandler("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+		testutil.Equals(t, "partial", string(b))
+	})
+	t.Run("panic keeps handler stack", func(t *testing.T) {
+		h := NewTimeoutMiddleware(prometheus.NewRegistry(), time.Minute).WrapHandler("/", http.HandlerFunc(panickingHandler))
+		defer func() {
+			hp, ok := recover().(*handlerPanic)
+			testutil.Assert(t, ok, "expected *handlerPanic")
+			testutil.Equals(t, "boom", hp.value)
+			testutil.Assert(t, strings.Contains(string(hp.stack), "panickingHandler"), "stack does not contain handler: %s", hp.stack)
+		}()
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func panickingHandler(http.ResponseWriter, *http.Request) {
+	panic("boom")
+}
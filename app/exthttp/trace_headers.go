@@ -0,0 +1,78 @@
+package exthttp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/tracing"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceIDHeader carries the ID of the sampled trace the request was part of.
+	TraceIDHeader = "X-Trace-Id"
+	// ServerTimingHeader carries durations of request phases, see https://www.w3.org/TR/server-timing/.
+	ServerTimingHeader = "Server-Timing"
+)
+
+type traceHeadersMiddleware struct{}
+
+// NewTraceHeadersMiddleware provides Middleware that lets clients link responses to traces and see where the time
+// went, without parsing the body. It sets "traceparent" (W3C trace context of the request span) and, if the trace is
+// sampled, TraceIDHeader response headers. It also sets ServerTimingHeader with "total" time until response headers
+// were sent and durations of phases that finished by then, recorded by tracing.DoInSpan. It has to be wrapped by
+// traced InstrumentationMiddleware to see the request span.
+func NewTraceHeadersMiddleware() Middleware {
+	return traceHeadersMiddleware{}
+}
+
+func (traceHeadersMiddleware) WrapHandler(_ string, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, timings := tracing.WithTimings(r.Context())
+
+		if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+			propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+			if spanCtx.IsSampled() {
+				w.Header().Set(TraceIDHeader, spanCtx.TraceID().String())
+			}
+		}
+
+		wd := newResponseWriterDelegator(w)
+		wd.beforeFirstByte = func() {
+			w.Header().Set(ServerTimingHeader, serverTiming(time.Since(start), timings.All()))
+		}
+		handler.ServeHTTP(wd.wrapped(), r.WithContext(ctx))
+
+		if wd.FirstByte().IsZero() {
+			// Handler wrote nothing, headers are sent once it returns.
+			wd.beforeFirstByte()
+		}
+	}
+}
+
+// serverTiming formats Server-Timing header value with durations in milliseconds.
+func serverTiming(total time.Duration, timings []tracing.Timing) string {
+	metrics := make([]string, 0, len(timings)+1)
+	for _, t := range timings {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", serverTimingName(t.Name), durationMs(t.Duration)))
+	}
+	return strings.Join(append(metrics, fmt.Sprintf("total;dur=%.3f", durationMs(total))), ", ")
+}
+
+// serverTimingName replaces characters not allowed in header token with "_".
+func serverTimingName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
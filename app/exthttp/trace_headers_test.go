@@ -0,0 +1,102 @@
+package exthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/tracing"
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceHeadersMiddleware(t *testing.T) {
+	sampledCtx, sampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample())).Tracer("test").Start(context.Background(), "test")
+	defer sampled.End()
+	unsampledCtx, unsampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())).Tracer("test").Start(context.Background(), "test")
+	defer unsampled.End()
+
+	var (
+		writeAfterPhase = func(w http.ResponseWriter, r *http.Request) {
+			tracing.DoInSpan(r.Context(), "db query", func(context.Context, tracing.Span) {})
+			w.WriteHeader(http.StatusOK)
+			// Finished after headers were sent, so it can't be reported.
+			tracing.DoInSpan(r.Context(), "after", func(context.Context, tracing.Span) {})
+		}
+		writeNothing = func(w http.ResponseWriter, r *http.Request) {
+			tracing.DoInSpan(r.Context(), "db query", func(context.Context, tracing.Span) {})
+			tracing.DoInSpan(r.Context(), "render", func(context.Context, tracing.Span) {})
+		}
+	)
+
+	for _, tcase := range []struct {
+		name    string
+		ctx     context.Context
+		handler http.HandlerFunc
+
+		expTraceparent  *regexp.Regexp
+		expTraceID      string
+		expServerTiming *regexp.Regexp
+	}{
+		{
+			name:            "no trace",
+			ctx:             context.Background(),
+			handler:         writeAfterPhase,
+			expServerTiming: regexp.MustCompile(`^db_query;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:            "sampled trace",
+			ctx:             sampledCtx,
+			handler:         writeAfterPhase,
+			expTraceparent:  regexp.MustCompile(`^00-` + sampled.SpanContext().TraceID().String() + `-[0-9a-f]{16}-01$`),
+			expTraceID:      sampled.SpanContext().TraceID().String(),
+			expServerTiming: regexp.MustCompile(`^db_query;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:            "not sampled trace",
+			ctx:             unsampledCtx,
+			handler:         writeAfterPhase,
+			expTraceparent:  regexp.MustCompile(`^00-` + unsampled.SpanContext().TraceID().String() + `-[0-9a-f]{16}-00$`),
+			expServerTiming: regexp.MustCompile(`^db_query;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:            "nothing written",
+			ctx:             context.Background(),
+			handler:         writeNothing,
+			expServerTiming: regexp.MustCompile(`^db_query;dur=\d+\.\d{3}, render;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`),
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewTraceHeadersMiddleware().WrapHandler("/ping", tcase.handler).
+				ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil).WithContext(tcase.ctx))
+
+			if tcase.expTraceparent != nil {
+				testutil.Assert(t, tcase.expTraceparent.MatchString(rec.Header().Get("traceparent")), "unexpected traceparent %q", rec.Header().Get("traceparent"))
+			} else {
+				testutil.Equals(t, "", rec.Header().Get("traceparent"))
+			}
+			testutil.Equals(t, tcase.expTraceID, rec.Header().Get(TraceIDHeader))
+			testutil.Assert(t, tcase.expServerTiming.MatchString(rec.Header().Get(ServerTimingHeader)), "unexpected Server-Timing %q", rec.Header().Get(ServerTimingHeader))
+		})
+	}
+}
+
+func TestServerTimingName(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		exp  string
+	}{
+		{name: "db", exp: "db"},
+		{name: "addingLatencyBasedOnProbability", exp: "addingLatencyBasedOnProbability"},
+		{name: "db query", exp: "db_query"},
+		{name: "cache;dur=1, total", exp: "cache_dur_1__total"},
+		{name: "p99.9-latency~", exp: "p99.9-latency~"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.exp, serverTimingName(tcase.name))
+		})
+	}
+}
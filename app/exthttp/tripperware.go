@@ -0,0 +1,12 @@
+package exthttp
+
+import (
+	"net/http"
+)
+
+// Tripperware wraps an http.RoundTripper with additional behavior.
+// Tripperwares are meant to be chained, e.g. InstrumentationTripperware on top of RetryTripperware, so the
+// order defines what each of them observes.
+type Tripperware interface {
+	WrapRoundTripper(targetName string, next http.RoundTripper) http.RoundTripper
+}
@@ -0,0 +1,84 @@
+package exthttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrInvalidResponse is matched (using errors.Is) by errors returned when response fails validation, see
+// NewResponseValidationTripperware.
+var ErrInvalidResponse = errors.New("invalid response")
+
+// InvalidResponseError is returned instead of response that failed validation.
+type InvalidResponseError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *InvalidResponseError) Error() string {
+	return fmt.Sprintf("invalid response with status code %d: %v", e.StatusCode, e.Err)
+}
+
+// Is makes InvalidResponseError match ErrInvalidResponse.
+func (e *InvalidResponseError) Is(target error) bool { return target == ErrInvalidResponse }
+
+// ResponseValidator returns error if response does not satisfy the contract. Body contains up to
+// maxValidatedBodySize bytes of the response body.
+type ResponseValidator func(resp *http.Response, body []byte) error
+
+// maxValidatedBodySize is the maximum size of the body read for validation.
+const maxValidatedBodySize = 1 << 20
+
+type validationTripperware struct {
+	validate ResponseValidator
+}
+
+// NewResponseValidationTripperware returns Tripperware that validates responses and turns invalid ones into
+// InvalidResponseError, so a server returning e.g 200 with garbage is not considered healthy. When placed below
+// InstrumentationTripperware, invalid responses are counted and timed with their status code and "invalid_response"
+// reason and recorded on the request span. Placed below retries and circuit breaker, invalid responses are retried
+// based on their status code and count as failures of the circuit breaker.
+func NewResponseValidationTripperware(validate ResponseValidator) Tripperware {
+	return &validationTripperware{validate: validate}
+}
+
+func (v *validationTripperware) WrapRoundTripper(_ string, next http.RoundTripper) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxValidatedBodySize))
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+
+		span := trace.SpanFromContext(req.Context())
+		if verr := v.validate(resp, body); verr != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			span.SetAttributes(attribute.Bool("response.valid", false))
+			span.AddEvent("response validation failed", trace.WithAttributes(attribute.String("error", verr.Error())))
+			return nil, &InvalidResponseError{StatusCode: resp.StatusCode, Err: verr}
+		}
+		span.SetAttributes(attribute.Bool("response.valid", true))
+
+		// Give the caller the whole body back, including part that was not read.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return resp, nil
+	})
+}
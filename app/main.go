@@ -33,6 +33,10 @@ var (
 	appVersion         = flag.String("set-version", "first", "Injected version to be presented via metrics.")
 	lat                = flag.String("latency", "90%500ms,10%200ms", "Encoded latency and probability of the response in format as: <probability>%<duration>,<probability>%<duration>....")
 	successProb        = flag.Float64("success-prob", 100, "The probability (in %) of getting a successful response")
+	concurrencyLimiter = flag.String("concurrency-limiter", "", "If set, /ping sheds requests above the concurrency limit with 503. One of 'static', 'aimd' or 'gradient' (adaptive, based on observed latency).")
+	concurrencyLimit   = flag.Int("concurrency-limit", 100, "The static concurrency limit or the initial limit of adaptive concurrency limiters.")
+	handlerTimeout     = flag.Duration("handler-timeout", 0, "If positive, /ping requests taking longer are cancelled and responded with 503. Zero disables the timeout.")
+	panicProb          = flag.Float64("panic-prob", 0, "The probability (in %) of the handler panicking, to exercise panic recovery")
 	traceEndpoint      = flag.String("trace-endpoint", "tempo.demo.svc.cluster.local:9091", "The gRPC OTLP endpoint for tracing backend. Hack: Set it to 'stdout' to print traces to the output instead")
 	traceSamplingRatio = flag.Float64("trace-sampling-ratio", 1.0, "Sampling ratio")
 )
@@ -75,28 +79,46 @@ func newLatencyDecider(encodedLatencies string) (*latencyDecider, error) {
 	return &l, nil
 }
 
-func (l latencyDecider) AddLatency(ctx context.Context) {
-	_, span := tracing.Start(ctx, "addingLatencyBasedOnProbability")
-	defer span.End()
-
-	n := rand.Float64() * 100
-	span.SetAttributes(attribute.Array("latencyProbabilities", l.probabilities))
-	span.SetAttributes(attribute.Float64("lucky%", n))
+// AddLatency waits for latency chosen based on probability. It returns context error if context is done earlier.
+func (l latencyDecider) AddLatency(ctx context.Context) (err error) {
+	tracing.DoInSpan(ctx, "addingLatencyBasedOnProbability", func(ctx context.Context, span tracing.Span) {
+		n := rand.Float64() * 100
+		span.SetAttributes(attribute.Array("latencyProbabilities", l.probabilities))
+		span.SetAttributes(attribute.Float64("lucky%", n))
 
-	for i, p := range l.probabilities {
-		if n <= p {
-			span.SetAttributes(attribute.String("latencyIntroduced", l.latencies[i].String()))
-			<-time.After(l.latencies[i])
-			return
+		for i, p := range l.probabilities {
+			if n <= p {
+				span.SetAttributes(attribute.String("latencyIntroduced", l.latencies[i].String()))
+				select {
+				case <-ctx.Done():
+					span.SetAttributes(attribute.Bool("interrupted", true))
+					err = ctx.Err()
+				case <-time.After(l.latencies[i]):
+				}
+				return
+			}
 		}
-	}
+	})
+	return err
 }
 
 func handlerPing(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracing.Start(r.Context(), "pingHandler")
 	defer span.End()
 
-	latDecider.AddLatency(ctx)
+	// Let clients know which version served them, so they can split their stats per version.
+	w.Header().Set("X-App-Version", *appVersion)
+
+	if err := latDecider.AddLatency(ctx); err != nil {
+		// Client is not waiting anymore (or server is shutting down), don't pretend we did the work.
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
+	if rand.Float64()*100 < *panicProb {
+		// Fault mode showing how panics are recovered and observed.
+		panic(fmt.Sprintf("injected panic with %v%% probability", *panicProb))
+	}
 
 	tracing.DoInSpan(ctx, "writeStatusBasedOnSuccessProbability", func(ctx context.Context, span tracing.Span) {
 		n := rand.Float64() * 100
@@ -109,10 +131,6 @@ func handlerPing(w http.ResponseWriter, r *http.Request) {
 		} else {
 			w.WriteHeader(500)
 		}
-
-		if span.SpanContext().HasTraceID() && span.SpanContext().IsSampled() {
-			_, _ = fmt.Fprintf(w, "BTW, here is (sampled) trace ID: %v", span.SpanContext().TraceID().String())
-		}
 	})
 }
 
@@ -164,18 +182,40 @@ func runMain() (err error) {
 		fmt.Println("Tracing enabled", *traceEndpoint)
 	}
 
+	var ping http.Handler = exthttp.NewTimeoutMiddleware(reg, *handlerTimeout).
+		WrapHandler("/ping", exthttp.NewDeadlineMiddleware(reg).
+			WrapHandler("/ping", http.HandlerFunc(handlerPing)))
+	if *concurrencyLimiter != "" {
+		limit, err := exthttp.NewConcurrencyLimitMiddleware(reg, *concurrencyLimiter, exthttp.WithConcurrencyLimit(*concurrencyLimit))
+		if err != nil {
+			return errors.Wrap(err, "create concurrency limit middleware")
+		}
+		// Below trace headers and recovery, so shed responses have trace headers too and panics are recovered.
+		// Timeout applies only to admitted requests.
+		ping = limit.WrapHandler("/ping", ping)
+	}
+	// Trace and timing headers let clients link responses to traces, instead of trace ID in the body.
+	ping = exthttp.NewTraceHeadersMiddleware().
+		WrapHandler("/ping", exthttp.NewRecoveryMiddleware(reg, nil).
+			WrapHandler("/ping", ping))
+
 	m := http.NewServeMux()
-	m.Handle("/metrics", exthttp.NewInstrumentationMiddleware(reg, nil, nil).
-		WrapHandler("/metrics", promhttp.HandlerFor(
-			reg,
-			promhttp.HandlerOpts{
-				// Opt into OpenMetrics to support exemplars.
-				EnableOpenMetrics: true,
-			},
-		)))
-	m.HandleFunc("/ping", exthttp.NewInstrumentationMiddleware(reg, nil, tracingProvider).
-		WrapHandler("/ping", http.HandlerFunc(handlerPing)))
-	srv := http.Server{Addr: *addr, Handler: m}
+	m.Handle("/metrics", promhttp.HandlerFor(
+		reg,
+		promhttp.HandlerOpts{
+			// Opt into OpenMetrics to support exemplars.
+			EnableOpenMetrics: true,
+		},
+	))
+	m.Handle("/ping", ping)
+	instr := exthttp.NewInstrumentationMiddleware(reg, tracingProvider,
+		// Exemplars show which version (e.g failing canary) the trace comes from. Trace ID with version fits
+		// exemplar length limit better than with span ID.
+		exthttp.WithExemplarLabels(prometheus.Labels{"version": *appVersion}),
+		// Scrapes every few seconds would flood tracing backend.
+		exthttp.WithoutTracing("/metrics"),
+	)
+	srv := http.Server{Addr: *addr, Handler: exthttp.InstrumentRoutes(instr, m)}
 
 	// Setup multiple 2 jobs. One is for serving HTTP requests, second to listen for Linux signals like Ctrl+C.
 	g := &run.Group{}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/exthttp"
+	"github.com/pkg/errors"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// assertionsConfig describes the response contract of the target. Responses that break it are counted as
+// failed requests with "invalid_response" reason, even if status code is fine. All set assertions have to pass.
+type assertionsConfig struct {
+	// Status codes that are expected. Empty means any.
+	Status []int `yaml:"status"`
+	// Headers that have to match given regexes, e.g Content-Type: "^application/json".
+	Headers map[string]string `yaml:"headers"`
+	// BodyRegex has to match the body.
+	BodyRegex string `yaml:"body_regex"`
+	// JSONSchema is a path to JSON Schema file the body has to be valid against.
+	JSONSchema string `yaml:"json_schema"`
+}
+
+// validator compiles assertions into response validator.
+func (a assertionsConfig) validator() (exthttp.ResponseValidator, error) {
+	status := map[int]struct{}{}
+	for _, c := range a.Status {
+		status[c] = struct{}{}
+	}
+
+	headers := map[string]*regexp.Regexp{}
+	for h, r := range a.Headers {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compile regex of header %v", h)
+		}
+		headers[http.CanonicalHeaderKey(h)] = re
+	}
+
+	var body *regexp.Regexp
+	if a.BodyRegex != "" {
+		var err error
+		if body, err = regexp.Compile(a.BodyRegex); err != nil {
+			return nil, errors.Wrap(err, "compile body regex")
+		}
+	}
+
+	var schema *jsonschema.Schema
+	if a.JSONSchema != "" {
+		var err error
+		if schema, err = jsonschema.Compile(a.JSONSchema); err != nil {
+			return nil, errors.Wrapf(err, "compile JSON schema %v", a.JSONSchema)
+		}
+	}
+
+	return func(resp *http.Response, b []byte) error {
+		if _, ok := status[resp.StatusCode]; len(status) > 0 && !ok {
+			return errors.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		for h, re := range headers {
+			if v := resp.Header.Get(h); !re.MatchString(v) {
+				return errors.Errorf("header %v value %q does not match %v", h, v, re)
+			}
+		}
+		if body != nil && !body.Match(b) {
+			return errors.Errorf("body does not match %v", body)
+		}
+		if schema != nil {
+			d := json.NewDecoder(bytes.NewReader(b))
+			d.UseNumber()
+			var v interface{}
+			if err := d.Decode(&v); err != nil {
+				return errors.Wrap(err, "parse body as JSON")
+			}
+			if err := schema.Validate(v); err != nil {
+				return errors.Wrap(err, "validate body against JSON schema")
+			}
+		}
+		return nil
+	}, nil
+}
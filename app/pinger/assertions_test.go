@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestAssertionsConfig_Validator(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	testutil.Ok(t, ioutil.WriteFile(schemaFile, []byte(`{
+	"type": "object",
+	"required": ["version"],
+	"properties": {"version": {"type": "string"}, "count": {"type": "integer"}}
+}`), 0600))
+
+	jsonResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}}
+
+	for _, tcase := range []struct {
+		name string
+		cfg  assertionsConfig
+		resp *http.Response
+		body string
+
+		expCompileErr  bool
+		expValidateErr bool
+	}{
+		{name: "no assertions", resp: &http.Response{StatusCode: http.StatusInternalServerError}},
+		{name: "invalid header regex", cfg: assertionsConfig{Headers: map[string]string{"x": "("}}, expCompileErr: true},
+		{name: "invalid body regex", cfg: assertionsConfig{BodyRegex: "("}, expCompileErr: true},
+		{name: "missing JSON schema", cfg: assertionsConfig{JSONSchema: filepath.Join(t.TempDir(), "missing.json")}, expCompileErr: true},
+		{name: "expected status", cfg: assertionsConfig{Status: []int{200, 204}}, resp: jsonResp},
+		{name: "unexpected status", cfg: assertionsConfig{Status: []int{204}}, resp: jsonResp, expValidateErr: true},
+		{name: "matching header", cfg: assertionsConfig{Headers: map[string]string{"content-type": "^application/json"}}, resp: jsonResp},
+		{name: "not matching header", cfg: assertionsConfig{Headers: map[string]string{"Content-Type": "^text/plain"}}, resp: jsonResp, expValidateErr: true},
+		{name: "missing header", cfg: assertionsConfig{Headers: map[string]string{"X-Version": "."}}, resp: jsonResp, expValidateErr: true},
+		{name: "matching body", cfg: assertionsConfig{BodyRegex: "^pong"}, resp: jsonResp, body: "pong v1"},
+		{name: "not matching body", cfg: assertionsConfig{BodyRegex: "^pong"}, resp: jsonResp, body: "error", expValidateErr: true},
+		{name: "valid JSON", cfg: assertionsConfig{JSONSchema: schemaFile}, resp: jsonResp, body: `{"version": "v1", "count": 1}`},
+		{name: "invalid JSON", cfg: assertionsConfig{JSONSchema: schemaFile}, resp: jsonResp, body: `{"version": "v1", "count": 1.5}`, expValidateErr: true},
+		{name: "missing JSON field", cfg: assertionsConfig{JSONSchema: schemaFile}, resp: jsonResp, body: `{"count": 1}`, expValidateErr: true},
+		{name: "not JSON", cfg: assertionsConfig{JSONSchema: schemaFile}, resp: jsonResp, body: `pong`, expValidateErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			validate, err := tcase.cfg.validator()
+			if tcase.expCompileErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+
+			err = validate(tcase.resp, []byte(tcase.body))
+			if tcase.expValidateErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/exthttp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// config represents pinger configuration file.
+type config struct {
+	Targets  []targetConfig  `yaml:"targets"`
+	Journeys []journeyConfig `yaml:"journeys"`
+	Shadows  []shadowConfig  `yaml:"shadows"`
+}
+
+// targetConfig represents single target to ping.
+type targetConfig struct {
+	// Name is used as "target" label in metrics.
+	Name     string `yaml:"name"`
+	Endpoint string `yaml:"endpoint"`
+	// PingsPerSecond of plain pings. Set it to 0 explicitly to use the target only for journeys.
+	PingsPerSecond *int `yaml:"pings_per_second"`
+	// VirtualUsers switches the target to closed loop model: given number of users send ping, wait for the response
+	// and think time, then repeat. PingsPerSecond is ignored then. Set it to 0 explicitly for open loop with fixed
+	// arrival rate.
+	VirtualUsers *int `yaml:"virtual_users"`
+	// ThinkTime of virtual users between receiving response and sending the next ping.
+	ThinkTime model.Duration `yaml:"think_time"`
+	// Timeout of single ping. The remaining time is propagated to the app, so it can stop early.
+	Timeout model.Duration `yaml:"timeout"`
+	// Discovery of instances behind the target to probe each of them directly. Optional.
+	Discovery *discoveryConfig `yaml:"discovery"`
+	// Faults injected into requests to simulate poor network between the pinger and the target. Optional.
+	Faults *faultsConfig `yaml:"faults"`
+	// Assertions on responses, so target returning e.g 200 with garbage is not considered healthy. Optional.
+	Assertions *assertionsConfig `yaml:"assertions"`
+	// Requests is a weighted mix of request templates to send. If empty, plain GET to the endpoint is sent.
+	Requests []*requestTemplate `yaml:"requests"`
+}
+
+// faultsConfig configures network faults injected by the client, see exthttp.NewFaultInjectionTripperware.
+type faultsConfig struct {
+	// Latency added to every request, randomly varied by +/- Jitter.
+	Latency model.Duration `yaml:"latency"`
+	Jitter  model.Duration `yaml:"jitter"`
+	// ConnectionErrorRatio (0-1) of requests failed with connection error without being sent.
+	ConnectionErrorRatio float64 `yaml:"connection_error_ratio"`
+	// BandwidthBytesPerSecond throttles request and response bodies. 0 means no limit. Response body is slowed
+	// only while it is read, so it affects ping latency, but not the client request duration metric.
+	BandwidthBytesPerSecond int `yaml:"bandwidth_bytes_per_second"`
+}
+
+func (f faultsConfig) options() []exthttp.FaultOption {
+	return []exthttp.FaultOption{
+		exthttp.WithFaultLatency(time.Duration(f.Latency), time.Duration(f.Jitter)),
+		exthttp.WithFaultConnectionErrors(f.ConnectionErrorRatio),
+		exthttp.WithFaultBandwidth(f.BandwidthBytesPerSecond),
+	}
+}
+
+func (t targetConfig) timeout() time.Duration {
+	return time.Duration(t.Timeout)
+}
+
+// loadRequestTemplates parses file with list of request templates. Empty path means no templates.
+func loadRequestTemplates(path string) ([]*requestTemplate, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read request templates file %v", path)
+	}
+
+	var templates []*requestTemplate
+	if err := yaml.UnmarshalStrict(b, &templates); err != nil {
+		return nil, errors.Wrapf(err, "parse request templates file %v", path)
+	}
+	return templates, nil
+}
+
+// loadConfig parses configuration file. If path is empty, single target configured with flags is returned.
+// Unset target fields are taken from defaults.
+func loadConfig(path string, defaults targetConfig) (config, error) {
+	c := config{Targets: []targetConfig{defaults}}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config{}, errors.Wrapf(err, "read config file %v", path)
+		}
+
+		c = config{}
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return config{}, errors.Wrapf(err, "parse config file %v", path)
+		}
+	}
+	if len(c.Targets) == 0 {
+		return config{}, errors.Errorf("no targets configured in %v", path)
+	}
+
+	names := map[string]struct{}{}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.Name == "" || t.Endpoint == "" {
+			return config{}, errors.Errorf("target %d: name and endpoint are required", i)
+		}
+		if _, ok := names[t.Name]; ok {
+			return config{}, errors.Errorf("target %q: duplicated name", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		if t.Discovery != nil {
+			if err := t.Discovery.validate(); err != nil {
+				return config{}, errors.Wrapf(err, "target %q", t.Name)
+			}
+		}
+		if t.Faults != nil && (t.Faults.ConnectionErrorRatio < 0 || t.Faults.ConnectionErrorRatio > 1 || t.Faults.BandwidthBytesPerSecond < 0) {
+			return config{}, errors.Errorf("target %q: fault connection_error_ratio has to be within 0-1 and bandwidth_bytes_per_second can't be negative", t.Name)
+		}
+		if t.PingsPerSecond == nil {
+			t.PingsPerSecond = defaults.PingsPerSecond
+		}
+		if t.VirtualUsers == nil {
+			t.VirtualUsers = defaults.VirtualUsers
+		}
+		if t.ThinkTime == 0 {
+			t.ThinkTime = defaults.ThinkTime
+		}
+		if *t.VirtualUsers < 0 || t.ThinkTime < 0 {
+			return config{}, errors.Errorf("target %q: virtual_users and think_time can't be negative", t.Name)
+		}
+		if t.Timeout == 0 {
+			t.Timeout = defaults.Timeout
+		}
+		if t.Timeout < 0 {
+			return config{}, errors.Errorf("target %q: timeout can't be negative", t.Name)
+		}
+		if len(t.Requests) == 0 {
+			t.Requests = defaults.Requests
+		}
+	}
+
+	for i, j := range c.Journeys {
+		if j.Name == "" || len(j.Steps) == 0 {
+			return config{}, errors.Errorf("journey %d: name and steps are required", i)
+		}
+		if j.Target == "" {
+			c.Journeys[i].Target = c.Targets[0].Name
+		} else if _, ok := names[j.Target]; !ok {
+			return config{}, errors.Errorf("journey %q: target %q not found", j.Name, j.Target)
+		}
+		if j.PerSecond < 0 {
+			return config{}, errors.Errorf("journey %q: per_second can't be negative", j.Name)
+		}
+		if j.PerSecond == 0 {
+			c.Journeys[i].PerSecond = 1
+		}
+	}
+
+	for i := range c.Shadows {
+		sh := &c.Shadows[i]
+		if sh.Name == "" || sh.Primary == "" || sh.Shadow == "" {
+			return config{}, errors.Errorf("shadow %d: name, primary and shadow are required", i)
+		}
+		for _, t := range []string{sh.Primary, sh.Shadow} {
+			if _, ok := names[t]; !ok {
+				return config{}, errors.Errorf("shadow %q: target %q not found", sh.Name, t)
+			}
+		}
+		if sh.Primary == sh.Shadow {
+			return config{}, errors.Errorf("shadow %q: primary and shadow have to be different targets", sh.Name)
+		}
+		switch sh.Body {
+		case "":
+			sh.Body = bodyCompareExact
+		case bodyCompareExact, bodyCompareJSON, bodyCompareNone:
+		default:
+			return config{}, errors.Errorf("shadow %q: unknown body comparison %q", sh.Name, sh.Body)
+		}
+		if sh.PerSecond < 0 {
+			return config{}, errors.Errorf("shadow %q: per_second can't be negative", sh.Name)
+		}
+		if sh.PerSecond == 0 {
+			sh.PerSecond = 1
+		}
+	}
+	return c, nil
+}
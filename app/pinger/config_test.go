@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestLoadConfig_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	users := 0
+	defaults := targetConfig{Name: "ping", Endpoint: "http://app:8080/ping", VirtualUsers: &users, Timeout: model.Duration(5 * time.Second)}
+
+	for _, tcase := range []struct {
+		name     string
+		file     string
+		defaults func(targetConfig) targetConfig
+
+		expErr     bool
+		expTimeout time.Duration
+	}{
+		{name: "default timeout", expTimeout: 5 * time.Second},
+		{
+			name:     "negative timeout flag",
+			defaults: func(d targetConfig) targetConfig { d.Timeout = model.Duration(-time.Second); return d },
+			expErr:   true,
+		},
+		{name: "timeout from file", file: "targets:\n- name: app\n  endpoint: http://app:8080/ping\n  timeout: 1s\n", expTimeout: time.Second},
+		{name: "timeout taken from flag", file: "targets:\n- name: app\n  endpoint: http://app:8080/ping\n", expTimeout: 5 * time.Second},
+		{name: "negative timeout in file", file: "targets:\n- name: app\n  endpoint: http://app:8080/ping\n  timeout: -1s\n", expErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			d := defaults
+			if tcase.defaults != nil {
+				d = tcase.defaults(d)
+			}
+			path := ""
+			if tcase.file != "" {
+				path = filepath.Join(dir, "config.yaml")
+				testutil.Ok(t, ioutil.WriteFile(path, []byte(tcase.file), os.ModePerm))
+			}
+
+			cfg, err := loadConfig(path, d)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expTimeout, cfg.Targets[0].timeout())
+		})
+	}
+}
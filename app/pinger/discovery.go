@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/exthttp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+// discoveryConfig configures discovery of individual instances (e.g pods) behind the target, so they can be probed
+// directly, regardless of how the Service balances traffic. Exactly one of Address and File has to be set.
+type discoveryConfig struct {
+	// Address to resolve with DNS, same as in Thanos: "dns+<host>[:<port>]" for A/AAAA records (port defaults to
+	// the endpoint one) or "dnssrv+<name>" for SRV records, e.g "dnssrv+_http._tcp.app-headless.demo.svc.cluster.local".
+	Address string `yaml:"address"`
+	// File with one "<host>:<port>" per line, e.g kept updated by Kubernetes Endpoints watcher. Lines starting with # are ignored.
+	File string `yaml:"file"`
+	// RefreshInterval of the discovery. Default is 30s.
+	RefreshInterval model.Duration `yaml:"refresh_interval"`
+	// MaxInstances bounds the number of probed instances and so the cardinality of "instance" label. Default is 10.
+	MaxInstances int `yaml:"max_instances"`
+	// PingsPerSecond sent to every instance. Default is 1.
+	PingsPerSecond float64 `yaml:"pings_per_second"`
+}
+
+func (d *discoveryConfig) validate() error {
+	if (d.Address == "") == (d.File == "") {
+		return errors.New("exactly one of discovery address or file has to be set")
+	}
+	if d.Address != "" && !strings.HasPrefix(d.Address, "dns+") && !strings.HasPrefix(d.Address, "dnssrv+") {
+		return errors.Errorf("discovery address %v has to start with dns+ or dnssrv+", d.Address)
+	}
+	if d.RefreshInterval == 0 {
+		d.RefreshInterval = model.Duration(30 * time.Second)
+	}
+	if d.MaxInstances == 0 {
+		d.MaxInstances = 10
+	}
+	if d.PingsPerSecond == 0 {
+		d.PingsPerSecond = 1
+	}
+	if d.MaxInstances < 0 || d.PingsPerSecond < 0 {
+		return errors.New("discovery max_instances and pings_per_second can't be negative")
+	}
+	return nil
+}
+
+// resolve returns sorted, unique "<host>:<port>" addresses of instances. Port of the endpoint is used for A records.
+func (d *discoveryConfig) resolve(ctx context.Context, endpoint *url.URL) ([]string, error) {
+	var addrs []string
+	switch {
+	case d.File != "":
+		f, err := os.Open(d.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open discovery file %v", d.File)
+		}
+		defer func() { _ = f.Close() }()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(line); err != nil {
+				return nil, errors.Wrapf(err, "discovery file %v", d.File)
+			}
+			addrs = append(addrs, line)
+		}
+		if err := s.Err(); err != nil {
+			return nil, errors.Wrapf(err, "read discovery file %v", d.File)
+		}
+	case strings.HasPrefix(d.Address, "dnssrv+"):
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", strings.TrimPrefix(d.Address, "dnssrv+"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup SRV %v", d.Address)
+		}
+		for _, srv := range srvs {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	default:
+		host, port := strings.TrimPrefix(d.Address, "dns+"), endpointPort(endpoint)
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup %v", d.Address)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	sort.Strings(addrs)
+	uniq := addrs[:0]
+	for i, a := range addrs {
+		if i == 0 || a != addrs[i-1] {
+			uniq = append(uniq, a)
+		}
+	}
+	return uniq, nil
+}
+
+func endpointPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+type probeMetrics struct {
+	discovered *prometheus.GaugeVec
+	probes     *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	up         *prometheus.GaugeVec
+	version    *prometheus.GaugeVec
+}
+
+func newProbeMetrics(reg prometheus.Registerer) *probeMetrics {
+	return &probeMetrics{
+		discovered: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pinger_discovered_instances",
+			Help: "Number of instances discovered behind the target, including those not probed due to max instances limit.",
+		}, []string{"target"}),
+		probes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_instance_probes_total",
+			Help: "Tracks the number of pings sent directly to the discovered instance.",
+		}, []string{"target", "instance"}),
+		failures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_instance_probe_failures_total",
+			Help: "Tracks the number of failed (5xx or no response) pings sent directly to the discovered instance.",
+		}, []string{"target", "instance"}),
+		duration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pinger_instance_probe_duration_seconds",
+			Help:    "Tracks the latencies of pings sent directly to the discovered instance.",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60},
+		}, []string{"target", "instance"}),
+		up: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pinger_instance_up",
+			Help: "1 if the last ping sent directly to the discovered instance succeeded, 0 otherwise.",
+		}, []string{"target", "instance"}),
+		version: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pinger_instance_version_info",
+			Help: "App version reported by the discovered instance, always 1.",
+		}, []string{"target", "instance", "version"}),
+	}
+}
+
+// instanceProber probes every discovered instance of the target directly. Metrics of instances that disappeared
+// are deleted, so "instance" label is bounded by max instances.
+type instanceProber struct {
+	target   *pingTarget
+	cfg      discoveryConfig
+	endpoint *url.URL
+	client   *http.Client
+	metrics  *probeMetrics
+
+	wg      sync.WaitGroup
+	running map[string]context.CancelFunc
+}
+
+func newInstanceProber(t *pingTarget, client *http.Client, m *probeMetrics) (*instanceProber, error) {
+	u, err := url.Parse(t.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint %v", t.Endpoint)
+	}
+	return &instanceProber{
+		target:   t,
+		cfg:      *t.Discovery,
+		endpoint: u,
+		client:   client,
+		metrics:  m,
+		running:  map[string]context.CancelFunc{},
+	}, nil
+}
+
+// run refreshes discovered instances and probes them until context is canceled.
+func (p *instanceProber) run(ctx context.Context) {
+	defer p.wg.Wait()
+
+	for {
+		p.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.cfg.RefreshInterval)):
+		}
+	}
+}
+
+func (p *instanceProber) refresh(ctx context.Context) {
+	addrs, err := p.cfg.resolve(ctx, p.endpoint)
+	if err != nil {
+		// Keep probing last known instances.
+		fmt.Println("Failed to discover instances of target", p.target.Name, ":", err)
+		return
+	}
+	p.metrics.discovered.WithLabelValues(p.target.Name).Set(float64(len(addrs)))
+	if len(addrs) > p.cfg.MaxInstances {
+		fmt.Printf("Discovered %d instances of target %v, probing only first %d\n", len(addrs), p.target.Name, p.cfg.MaxInstances)
+		addrs = addrs[:p.cfg.MaxInstances]
+	}
+
+	current := map[string]struct{}{}
+	for _, a := range addrs {
+		current[a] = struct{}{}
+		if _, ok := p.running[a]; ok {
+			continue
+		}
+
+		ictx, cancel := context.WithCancel(ctx)
+		p.running[a] = cancel
+		p.wg.Add(1)
+		go func(instance string) {
+			defer p.wg.Done()
+			p.probe(ictx, instance)
+		}(a)
+	}
+	for instance, cancel := range p.running {
+		if _, ok := current[instance]; !ok {
+			cancel()
+			delete(p.running, instance)
+		}
+	}
+}
+
+// forget deletes metrics of the instance that is not probed anymore.
+func (p *instanceProber) forget(instance, version string) {
+	p.metrics.version.DeleteLabelValues(p.target.Name, instance, version)
+	p.metrics.probes.DeleteLabelValues(p.target.Name, instance)
+	p.metrics.failures.DeleteLabelValues(p.target.Name, instance)
+	p.metrics.duration.DeleteLabelValues(p.target.Name, instance)
+	p.metrics.up.DeleteLabelValues(p.target.Name, instance)
+}
+
+// probe pings the instance at configured rate until context is canceled.
+func (p *instanceProber) probe(ctx context.Context, instance string) {
+	var (
+		mu      sync.Mutex
+		version string
+	)
+	// Once spamAtRate returns there are no pings in flight, so deleted metrics are not recreated.
+	defer func() { p.forget(instance, version) }()
+
+	spamAtRate(ctx, p.cfg.PingsPerSecond, spamLimits{}, func() {
+		r, ok := p.target.send(ctx, p.client, func(ctx context.Context) (*http.Request, error) {
+			req, err := p.target.newRequest(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// Templates can override URL, so only host is replaced.
+			req.URL.Host = instance
+			return req, nil
+		})
+		if !ok || r.reason == exthttp.ReasonCanceled {
+			return
+		}
+
+		p.metrics.probes.WithLabelValues(p.target.Name, instance).Inc()
+		p.metrics.duration.WithLabelValues(p.target.Name, instance).Observe(r.latency.Seconds())
+		if r.failed() {
+			p.metrics.failures.WithLabelValues(p.target.Name, instance).Inc()
+			p.metrics.up.WithLabelValues(p.target.Name, instance).Set(0)
+			return
+		}
+		p.metrics.up.WithLabelValues(p.target.Name, instance).Set(1)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if r.version != version {
+			p.metrics.version.DeleteLabelValues(p.target.Name, instance, version)
+			version = r.version
+			p.metrics.version.WithLabelValues(p.target.Name, instance, version).Set(1)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func TestDiscoveryConfig_Validate(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		cfg  discoveryConfig
+
+		expErr bool
+		exp    discoveryConfig
+	}{
+		{
+			name: "defaults",
+			cfg:  discoveryConfig{Address: "dns+app-headless:8080"},
+			exp:  discoveryConfig{Address: "dns+app-headless:8080", RefreshInterval: model.Duration(30 * time.Second), MaxInstances: 10, PingsPerSecond: 1},
+		},
+		{
+			name: "explicit values",
+			cfg:  discoveryConfig{File: "instances.txt", RefreshInterval: model.Duration(time.Second), MaxInstances: 3, PingsPerSecond: 0.5},
+			exp:  discoveryConfig{File: "instances.txt", RefreshInterval: model.Duration(time.Second), MaxInstances: 3, PingsPerSecond: 0.5},
+		},
+		{name: "SRV", cfg: discoveryConfig{Address: "dnssrv+_http._tcp.app-headless"}, exp: discoveryConfig{Address: "dnssrv+_http._tcp.app-headless", RefreshInterval: model.Duration(30 * time.Second), MaxInstances: 10, PingsPerSecond: 1}},
+		{name: "nothing set", cfg: discoveryConfig{}, expErr: true},
+		{name: "both set", cfg: discoveryConfig{Address: "dns+app", File: "instances.txt"}, expErr: true},
+		{name: "address without scheme", cfg: discoveryConfig{Address: "app-headless:8080"}, expErr: true},
+		{name: "negative max instances", cfg: discoveryConfig{Address: "dns+app", MaxInstances: -1}, expErr: true},
+		{name: "negative pings per second", cfg: discoveryConfig{Address: "dns+app", PingsPerSecond: -1}, expErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			cfg := tcase.cfg
+			err := cfg.validate()
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.exp, cfg)
+		})
+	}
+}
+
+func TestDiscoveryConfig_Resolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	for _, tcase := range []struct {
+		name     string
+		cfg      discoveryConfig
+		file     string
+		endpoint string
+
+		expErr   bool
+		expAddrs []string
+	}{
+		{
+			name:     "file is sorted and deduplicated",
+			cfg:      discoveryConfig{File: filepath.Join(dir, "instances.txt")},
+			file:     "# pods of app\n10.0.0.2:8080\n\n 10.0.0.1:8080 \n10.0.0.2:8080\n",
+			expAddrs: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+		},
+		{name: "file without port", cfg: discoveryConfig{File: filepath.Join(dir, "instances.txt")}, file: "10.0.0.1\n", expErr: true},
+		{name: "missing file", cfg: discoveryConfig{File: filepath.Join(dir, "missing.txt")}, expErr: true},
+		{name: "A record with port", cfg: discoveryConfig{Address: "dns+127.0.0.1:9090"}, endpoint: "http://app:8080/ping", expAddrs: []string{"127.0.0.1:9090"}},
+		{name: "A record with endpoint port", cfg: discoveryConfig{Address: "dns+127.0.0.1"}, endpoint: "http://app:8080/ping", expAddrs: []string{"127.0.0.1:8080"}},
+		{name: "A record with default HTTPS port", cfg: discoveryConfig{Address: "dns+127.0.0.1"}, endpoint: "https://app/ping", expAddrs: []string{"127.0.0.1:443"}},
+		{name: "A record with default HTTP port", cfg: discoveryConfig{Address: "dns+127.0.0.1"}, endpoint: "http://app/ping", expAddrs: []string{"127.0.0.1:80"}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			if tcase.file != "" {
+				testutil.Ok(t, ioutil.WriteFile(tcase.cfg.File, []byte(tcase.file), os.ModePerm))
+			}
+			if tcase.endpoint == "" {
+				tcase.endpoint = "http://app:8080/ping"
+			}
+			u, err := url.Parse(tcase.endpoint)
+			testutil.Ok(t, err)
+
+			addrs, err := tcase.cfg.resolve(context.Background(), u)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expAddrs, addrs)
+		})
+	}
+}
+
+// instanceValues returns values of the gauge or counter by "instance" label.
+func instanceValues(t *testing.T, reg *prometheus.Registry, name string) map[string]float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	ret := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "instance" {
+					ret[l.GetValue()] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func TestInstanceProber(t *testing.T) {
+	newInstance := func(version string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("X-App-Version", version)
+			w.WriteHeader(status)
+		}))
+	}
+	healthy, failing := newInstance("first", http.StatusOK), newInstance("second", http.StatusInternalServerError)
+	defer healthy.Close()
+	defer failing.Close()
+	healthyAddr, failingAddr := strings.TrimPrefix(healthy.URL, "http://"), strings.TrimPrefix(failing.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "discovery")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+	file := filepath.Join(dir, "instances.txt")
+	testutil.Ok(t, ioutil.WriteFile(file, []byte(healthyAddr+"\n"+failingAddr+"\n"), os.ModePerm))
+
+	cfg := discoveryConfig{File: file, PingsPerSecond: 50}
+	testutil.Ok(t, cfg.validate())
+
+	reg := prometheus.NewRegistry()
+	target := &pingTarget{
+		targetConfig: targetConfig{Name: "app", Endpoint: "http://app-service:8080/ping", Timeout: model.Duration(5 * time.Second), Discovery: &cfg},
+		requests:     &requestMix{},
+	}
+	p, err := newInstanceProber(target, &http.Client{}, newProbeMetrics(reg))
+	testutil.Ok(t, err)
+
+	// eventually waits until the condition on metrics is true, as probes run in the background.
+	eventually := func(cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met in time")
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer p.wg.Wait()
+	defer cancel()
+
+	p.refresh(ctx)
+	eventually(func() bool {
+		return len(instanceValues(t, reg, "pinger_instance_up")) == 2 && len(instanceValues(t, reg, "pinger_instance_version_info")) == 1
+	})
+	testutil.Equals(t, map[string]float64{healthyAddr: 1, failingAddr: 0}, instanceValues(t, reg, "pinger_instance_up"))
+	testutil.Equals(t, map[string]float64{healthyAddr: 1}, instanceValues(t, reg, "pinger_instance_version_info"))
+	testutil.Equals(t, 0.0, instanceValues(t, reg, "pinger_instance_probe_failures_total")[healthyAddr])
+	testutil.Assert(t, instanceValues(t, reg, "pinger_instance_probe_failures_total")[failingAddr] > 0, "failing instance has no failures")
+
+	// Instance that disappeared is not probed anymore and its metrics are deleted.
+	testutil.Ok(t, ioutil.WriteFile(file, []byte(healthyAddr+"\n"), os.ModePerm))
+	p.refresh(ctx)
+	eventually(func() bool {
+		_, ok := instanceValues(t, reg, "pinger_instance_up")[failingAddr]
+		return !ok
+	})
+	for _, name := range []string{"pinger_instance_probes_total", "pinger_instance_probe_failures_total", "pinger_instance_up", "pinger_instance_version_info"} {
+		_, ok := instanceValues(t, reg, name)[failingAddr]
+		testutil.Assert(t, !ok, "metric %v of removed instance is still exported", name)
+	}
+	testutil.Equals(t, 1, len(p.running))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/tracing"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// journeyConfig describes scripted sequence of requests done by single user, e.g login, list and detail.
+type journeyConfig struct {
+	Name string `yaml:"name"`
+	// Target which client (and so metrics and timeout) is used for steps. Default is the first target.
+	Target string `yaml:"target"`
+	// PerSecond is the number of journeys started every second. Default is 1.
+	PerSecond float64        `yaml:"per_second"`
+	Steps     []*journeyStep `yaml:"steps"`
+}
+
+// journeyStep is a single request of the journey. Request templates can use values extracted
+// in previous steps e.g {{ .token }}. Cookies are kept for the whole journey.
+type journeyStep struct {
+	requestTemplate `yaml:",inline"`
+
+	// Extract values from the response to use in next steps. Step fails if value can't be extracted.
+	Extract map[string]extractor `yaml:"extract"`
+	// ThinkTime to wait after this step.
+	ThinkTime model.Duration `yaml:"think_time"`
+}
+
+// extractor takes value from the response. Exactly one of the fields has to be set.
+type extractor struct {
+	// Header name.
+	Header string `yaml:"header"`
+	// JSON path in dot notation e.g "items.0.id".
+	JSON string `yaml:"json"`
+	// Regex matched against the body. The first capture group is extracted.
+	Regex string `yaml:"regex"`
+
+	re *regexp.Regexp
+}
+
+func (e *extractor) compile() (err error) {
+	set := 0
+	for _, f := range []string{e.Header, e.JSON, e.Regex} {
+		if f != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of header, json or regex has to be set")
+	}
+	if e.Regex != "" {
+		if e.re, err = regexp.Compile(e.Regex); err != nil {
+			return errors.Wrapf(err, "compile regex %v", e.Regex)
+		}
+		if e.re.NumSubexp() < 1 {
+			return errors.Errorf("regex %v has to have capture group", e.Regex)
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extract(r result) (string, error) {
+	switch {
+	case e.Header != "":
+		v := r.header.Get(e.Header)
+		if v == "" {
+			return "", errors.Errorf("header %v not found", e.Header)
+		}
+		return v, nil
+	case e.JSON != "":
+		var v interface{}
+		if err := json.Unmarshal(r.body, &v); err != nil {
+			return "", errors.Wrap(err, "parse body as JSON")
+		}
+		return jsonPath(v, e.JSON)
+	default:
+		m := e.re.FindSubmatch(r.body)
+		if m == nil {
+			return "", errors.Errorf("regex %v does not match body", e.Regex)
+		}
+		return string(m[1]), nil
+	}
+}
+
+// jsonPath returns value from the decoded JSON under the dot separated path. Numbers in the path index arrays.
+func jsonPath(v interface{}, path string) (string, error) {
+	for _, p := range strings.Split(path, ".") {
+		switch o := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = o[p]; !ok {
+				return "", errors.Errorf("JSON path %v: key %v not found", path, p)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(o) {
+				return "", errors.Errorf("JSON path %v: invalid index %v", path, p)
+			}
+			v = o[i]
+		default:
+			return "", errors.Errorf("JSON path %v: can't get %v from scalar", path, p)
+		}
+	}
+
+	switch o := v.(type) {
+	case string:
+		return o, nil
+	case nil:
+		return "", errors.Errorf("JSON path %v: value is null", path)
+	default:
+		b, err := json.Marshal(o)
+		return string(b), err
+	}
+}
+
+type journeyMetrics struct {
+	journeys     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	stepFailures *prometheus.CounterVec
+}
+
+func newJourneyMetrics(reg prometheus.Registerer) *journeyMetrics {
+	return &journeyMetrics{
+		journeys: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_journeys_total",
+			Help: "Tracks the number of finished journeys.",
+		}, []string{"journey", "result"}),
+		duration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pinger_journey_duration_seconds",
+			Help:    "Tracks the duration of journeys, including think time.",
+			Buckets: []float64{0.1, 0.3, 0.6, 1, 2, 3, 5, 10, 20, 30, 60},
+		}, []string{"journey", "result"}),
+		stepFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_journey_step_failures_total",
+			Help: "Tracks the number of journeys failed on the given step.",
+		}, []string{"journey", "step"}),
+	}
+}
+
+type journey struct {
+	journeyConfig
+
+	target  *pingTarget
+	tracer  trace.Tracer
+	metrics *journeyMetrics
+}
+
+func newJourney(cfg journeyConfig, target *pingTarget, tp trace.TracerProvider, m *journeyMetrics) (*journey, error) {
+	for i, s := range cfg.Steps {
+		if s.Name == "" {
+			s.Name = strconv.Itoa(i)
+		}
+		if err := s.compile(); err != nil {
+			return nil, errors.Wrapf(err, "journey %v step %v", cfg.Name, s.Name)
+		}
+		for k, e := range s.Extract {
+			e := e
+			if err := e.compile(); err != nil {
+				return nil, errors.Wrapf(err, "journey %v step %v extract %v", cfg.Name, s.Name, k)
+			}
+			s.Extract[k] = e
+		}
+	}
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return &journey{journeyConfig: cfg, target: target, tracer: tp.Tracer("pinger"), metrics: m}, nil
+}
+
+// runJourneys starts configured number of journeys every second until context is canceled or limits are reached.
+// It waits for all journeys to finish before returning.
+func runJourneys(ctx context.Context, journeys []*journey, limits spamLimits, observe func(result)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, j := range journeys {
+		wg.Add(1)
+		go func(j *journey) {
+			defer wg.Done()
+			j.spam(ctx, limits, observe)
+		}(j)
+	}
+}
+
+func (j *journey) spam(ctx context.Context, limits spamLimits, observe func(result)) {
+	spamAtRate(ctx, j.PerSecond, limits, func() {
+		j.run(ctx, observe)
+	})
+}
+
+// run does single journey as a new trace. It stops on the first failed step.
+func (j *journey) run(ctx context.Context, observe func(result)) {
+	ctx, span := j.tracer.Start(ctx, "journey "+j.Name, trace.WithNewRoot())
+	defer span.End()
+
+	// Each journey is a separate user, so it has its own cookies.
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Transport: j.target.client.Transport, Jar: jar}
+
+	var (
+		start  = time.Now()
+		vars   = map[string]string{}
+		failed *journeyStep
+	)
+	for _, s := range j.Steps {
+		if err := j.runStep(ctx, client, s, vars, observe); err != nil {
+			failed = s
+			span.SetStatus(codes.Error, "step "+s.Name+" failed")
+			break
+		}
+
+		if s.ThinkTime > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(s.ThinkTime)):
+			}
+		}
+	}
+
+	res := "success"
+	if failed != nil {
+		res = "failure"
+		j.metrics.stepFailures.WithLabelValues(j.Name, failed.Name).Inc()
+	}
+	span.SetAttributes(attribute.String("result", res))
+	j.metrics.journeys.WithLabelValues(j.Name, res).Inc()
+	j.metrics.duration.WithLabelValues(j.Name, res).Observe(time.Since(start).Seconds())
+}
+
+func (j *journey) runStep(ctx context.Context, client *http.Client, s *journeyStep, vars map[string]string, observe func(result)) (err error) {
+	ctx, span := tracing.Start(ctx, "step "+s.Name)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	r, ok := j.target.send(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		return s.newRequest(ctx, j.target.Endpoint, vars)
+	})
+	if !ok {
+		return errors.New("request not sent")
+	}
+	j.target.latencies.observe(r)
+	observe(r)
+
+	span.SetAttributes(attribute.String("code", r.code))
+	if r.reason != "" {
+		return errors.Errorf("request failed: %v", r.reason)
+	}
+	if code, _ := strconv.Atoi(r.code); code >= 400 {
+		return errors.Errorf("unexpected status code %v", r.code)
+	}
+
+	for k, e := range s.Extract {
+		v, err := e.extract(r)
+		if err != nil {
+			return errors.Wrapf(err, "extract %v", k)
+		}
+		vars[k] = v
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// counterValue returns value of the counter with the given labels, or 0 if it was not created yet.
+func counterValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestJSONPath(t *testing.T) {
+	v := map[string]interface{}{
+		"token": "abc",
+		"items": []interface{}{map[string]interface{}{"id": float64(7)}},
+		"meta":  map[string]interface{}{"next": nil},
+	}
+
+	for _, tcase := range []struct {
+		path string
+
+		exp    string
+		expErr bool
+	}{
+		{path: "token", exp: "abc"},
+		{path: "items.0.id", exp: "7"},
+		{path: "items.0", exp: `{"id":7}`},
+		{path: "missing", expErr: true},
+		{path: "items.1", expErr: true},
+		{path: "items.first", expErr: true},
+		{path: "token.length", expErr: true},
+		{path: "meta.next", expErr: true},
+	} {
+		t.Run(tcase.path, func(t *testing.T) {
+			got, err := jsonPath(v, tcase.path)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.exp, got)
+		})
+	}
+}
+
+func TestExtractor(t *testing.T) {
+	r := result{
+		header: http.Header{"X-Token": []string{"from-header"}},
+		body:   []byte(`{"session": {"id": "s1"}} <a href="/items/42">`),
+	}
+
+	for _, tcase := range []struct {
+		name string
+		e    extractor
+
+		expCompileErr bool
+		exp           string
+		expErr        bool
+	}{
+		{name: "header", e: extractor{Header: "x-token"}, exp: "from-header"},
+		{name: "missing header", e: extractor{Header: "X-Other"}, expErr: true},
+		{name: "regex", e: extractor{Regex: `/items/(\d+)`}, exp: "42"},
+		{name: "regex not matching", e: extractor{Regex: `/users/(\d+)`}, expErr: true},
+		{name: "regex without capture group", e: extractor{Regex: `/items/\d+`}, expCompileErr: true},
+		{name: "invalid regex", e: extractor{Regex: `(`}, expCompileErr: true},
+		// Body with trailing HTML is not valid JSON.
+		{name: "json from invalid body", e: extractor{JSON: "session.id"}, expErr: true},
+		{name: "nothing set", e: extractor{}, expCompileErr: true},
+		{name: "many set", e: extractor{Header: "X-Token", JSON: "session.id"}, expCompileErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			e := tcase.e
+			err := e.compile()
+			if tcase.expCompileErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+
+			got, err := e.extract(r)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.exp, got)
+		})
+	}
+}
+
+func TestJourney_Run(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+			_, _ = fmt.Fprintln(w, `{"items": [{"id": 42}]}`)
+		case "/items/42":
+			if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("X-Owner", "me")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tcase := range []struct {
+		name  string
+		steps []*journeyStep
+
+		expResult     string
+		expFailedStep string
+		expCodes      []string
+	}{
+		{
+			name: "all steps succeed with extracted values and cookies",
+			steps: []*journeyStep{
+				{
+					requestTemplate: requestTemplate{Name: "login", URL: srv.URL + "/login"},
+					Extract:         map[string]extractor{"id": {JSON: "items.0.id"}},
+				},
+				{
+					requestTemplate: requestTemplate{Name: "detail", URL: srv.URL + "/items/{{ .id }}"},
+					Extract:         map[string]extractor{"owner": {Header: "X-Owner"}},
+				},
+			},
+			expResult: "success",
+			expCodes:  []string{"200", "200"},
+		},
+		{
+			name: "stops on unexpected status code",
+			steps: []*journeyStep{
+				{requestTemplate: requestTemplate{Name: "missing", URL: srv.URL + "/missing"}},
+				{requestTemplate: requestTemplate{Name: "login", URL: srv.URL + "/login"}},
+			},
+			expResult:     "failure",
+			expFailedStep: "missing",
+			expCodes:      []string{"404"},
+		},
+		{
+			name: "stops when value can't be extracted",
+			steps: []*journeyStep{
+				{
+					requestTemplate: requestTemplate{Name: "login", URL: srv.URL + "/login"},
+					Extract:         map[string]extractor{"token": {Header: "X-Token"}},
+				},
+				{requestTemplate: requestTemplate{Name: "detail", URL: srv.URL + "/items/42"}},
+			},
+			expResult:     "failure",
+			expFailedStep: "login",
+			expCodes:      []string{"200"},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			target := &pingTarget{
+				targetConfig: targetConfig{Name: "app", Endpoint: srv.URL, Timeout: model.Duration(5 * time.Second)},
+				client:       srv.Client(),
+				latencies:    newLatencyRecorder(reg, "app", time.Minute, nil),
+			}
+			j, err := newJourney(journeyConfig{Name: "browse", Steps: tcase.steps}, target, nil, newJourneyMetrics(reg))
+			testutil.Ok(t, err)
+
+			var (
+				mu    sync.Mutex
+				codes []string
+			)
+			j.run(context.Background(), func(r result) {
+				mu.Lock()
+				defer mu.Unlock()
+				codes = append(codes, r.code)
+			})
+
+			testutil.Equals(t, tcase.expCodes, codes)
+			testutil.Equals(t, 1.0, counterValue(t, reg, "pinger_journeys_total", map[string]string{"journey": "browse", "result": tcase.expResult}))
+			if tcase.expFailedStep != "" {
+				testutil.Equals(t, 1.0, counterValue(t, reg, "pinger_journey_step_failures_total", map[string]string{"journey": "browse", "step": tcase.expFailedStep}))
+			}
+		})
+	}
+}
+
+func TestNewJourney_InvalidStep(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		step *journeyStep
+	}{
+		{name: "invalid template", step: &journeyStep{requestTemplate: requestTemplate{Body: "{{ unknown }}"}}},
+		{name: "invalid extractor", step: &journeyStep{Extract: map[string]extractor{"a": {}}}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := newJourney(journeyConfig{Name: "test", Steps: []*journeyStep{tcase.step}}, nil, nil, newJourneyMetrics(prometheus.NewRegistry()))
+			testutil.NotOk(t, err)
+		})
+	}
+}
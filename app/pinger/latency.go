@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Latencies are recorded in microseconds from 1µs up to 1h with 3 significant figures, so quantiles
+	// are accurate to 0.1% in the whole range, unlike Prometheus buckets.
+	hdrMinMicros = 1
+	hdrMaxMicros = int64(time.Hour / time.Microsecond)
+	hdrSigFigs   = 3
+
+	// Window used for exported gauges and "window" debug summary is split into this many parts, so it slides smoothly.
+	latencyWindowParts = 6
+	// minLatencyWindow keeps every part of the window at least a second long, so rotation is cheap.
+	minLatencyWindow = latencyWindowParts * time.Second
+)
+
+func newHDRHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(hdrMinMicros, hdrMaxMicros, hdrSigFigs)
+}
+
+func recordLatency(h *hdrhistogram.Histogram, d time.Duration) {
+	v := int64(d / time.Microsecond)
+	if v < hdrMinMicros {
+		v = hdrMinMicros
+	}
+	if v > hdrMaxMicros {
+		v = hdrMaxMicros
+	}
+	// Values are clamped to the trackable range, so it can't fail.
+	_ = h.RecordValue(v)
+}
+
+func latencyAtQuantile(h *hdrhistogram.Histogram, q float64) time.Duration {
+	if h.TotalCount() == 0 {
+		return 0
+	}
+	return time.Duration(h.ValueAtPercentile(q*100)) * time.Microsecond
+}
+
+func maxLatency(h *hdrhistogram.Histogram) time.Duration {
+	if h.TotalCount() == 0 {
+		return 0
+	}
+	return time.Duration(h.Max()) * time.Microsecond
+}
+
+// latencyRecorder records ping latencies in high resolution HDR histograms. It keeps one histogram for
+// the whole run and one sliding over the recent window.
+type latencyRecorder struct {
+	mu       sync.Mutex
+	total    *hdrhistogram.Histogram
+	windowed *hdrhistogram.WindowedHistogram
+	window   time.Duration
+
+	quantiles    []float64
+	quantileDesc *prometheus.Desc
+}
+
+// newLatencyRecorder creates latencyRecorder. If quantiles are given, they are exported as gauges
+// calculated over the recent window. Window has to be at least minLatencyWindow.
+func newLatencyRecorder(reg prometheus.Registerer, target string, window time.Duration, quantiles []float64) *latencyRecorder {
+	l := &latencyRecorder{
+		total:     newHDRHistogram(),
+		windowed:  hdrhistogram.NewWindowed(latencyWindowParts, hdrMinMicros, hdrMaxMicros, hdrSigFigs),
+		window:    window,
+		quantiles: quantiles,
+		quantileDesc: prometheus.NewDesc(
+			"pinger_request_latency_quantile_seconds",
+			"Exact quantile of the request latencies calculated from high resolution histogram over recent window.",
+			[]string{"quantile"}, prometheus.Labels{"target": target},
+		),
+	}
+	if len(quantiles) > 0 {
+		reg.MustRegister(l)
+	}
+	return l
+}
+
+// Describe implements prometheus.Collector.
+func (l *latencyRecorder) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.quantileDesc
+}
+
+// Collect implements prometheus.Collector. Window is merged once per scrape, so all quantiles are consistent.
+func (l *latencyRecorder) Collect(ch chan<- prometheus.Metric) {
+	l.mu.Lock()
+	merged := l.windowed.Merge()
+	l.mu.Unlock()
+
+	for _, q := range l.quantiles {
+		ch <- prometheus.MustNewConstMetric(l.quantileDesc, prometheus.GaugeValue, latencyAtQuantile(merged, q).Seconds(), strconv.FormatFloat(q, 'f', -1, 64))
+	}
+}
+
+func (l *latencyRecorder) observe(r result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recordLatency(l.total, r.latency)
+	recordLatency(l.windowed.Current, r.latency)
+}
+
+// rotate slides the window until done is closed.
+func (l *latencyRecorder) rotate(done <-chan struct{}) {
+	t := time.NewTicker(l.window / latencyWindowParts)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		l.mu.Lock()
+		l.windowed.Rotate()
+		l.mu.Unlock()
+	}
+}
+
+type hdrSummary struct {
+	Count     int64              `json:"count"`
+	Mean      float64            `json:"mean_seconds"`
+	Max       float64            `json:"max_seconds"`
+	Quantiles map[string]float64 `json:"quantiles_seconds"`
+}
+
+var debugQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 0.9999}
+
+func summarizeHDR(h *hdrhistogram.Histogram) hdrSummary {
+	s := hdrSummary{
+		Count:     h.TotalCount(),
+		Max:       maxLatency(h).Seconds(),
+		Quantiles: map[string]float64{},
+	}
+	if s.Count > 0 {
+		s.Mean = (time.Duration(h.Mean()) * time.Microsecond).Seconds()
+	}
+	for _, q := range debugQuantiles {
+		s.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = latencyAtQuantile(h, q).Seconds()
+	}
+	return s
+}
+
+func (l *latencyRecorder) summary() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return map[string]interface{}{
+		"total":                   summarizeHDR(l.total),
+		"window":                  summarizeHDR(l.windowed.Merge()),
+		"window_duration_seconds": l.window.Seconds(),
+	}
+}
+
+// latencyHandler prints exact latency quantiles of all targets for the whole run and the recent window as JSON.
+func latencyHandler(targets []*pingTarget) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		resp := map[string]interface{}{
+			"lowest_trackable_value_micros": hdrMinMicros,
+			"significant_figures":           hdrSigFigs,
+		}
+		perTarget := map[string]interface{}{}
+		for _, t := range targets {
+			perTarget[t.Name] = t.latencies.summary()
+		}
+		resp["targets"] = perTarget
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	})
+}
+
+// parseQuantiles parses comma separated quantiles e.g "0.5,0.9,0.99".
+func parseQuantiles(encoded string) ([]float64, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var ret []float64
+	for _, e := range strings.Split(encoded, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(e), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse quantile %v as float", e)
+		}
+		if q <= 0 || q > 1 {
+			return nil, errors.Errorf("quantile has to be in (0, 1] range, got %v", q)
+		}
+		ret = append(ret, q)
+	}
+	return ret, nil
+}
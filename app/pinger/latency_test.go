@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quantileValues returns values of the latency quantile gauges by target and quantile label.
+func quantileValues(t *testing.T, reg *prometheus.Registry) map[string]map[string]float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	ret := map[string]map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "pinger_request_latency_quantile_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if ret[labels["target"]] == nil {
+				ret[labels["target"]] = map[string]float64{}
+			}
+			ret[labels["target"]][labels["quantile"]] = m.GetGauge().GetValue()
+		}
+	}
+	return ret
+}
+
+func TestLatencyRecorder_Quantiles(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	fast := newLatencyRecorder(reg, "fast", time.Minute, []float64{0.5, 1})
+	slow := newLatencyRecorder(reg, "slow", time.Minute, []float64{0.5, 1})
+	// Recorder without quantiles exports nothing.
+	_ = newLatencyRecorder(reg, "none", time.Minute, nil)
+
+	for i := 1; i <= 100; i++ {
+		fast.observe(result{latency: time.Duration(i) * time.Millisecond})
+		slow.observe(result{latency: time.Duration(i) * time.Second})
+	}
+
+	got := quantileValues(t, reg)
+	testutil.Equals(t, 2, len(got))
+	for target, exp := range map[string]map[string]float64{
+		"fast": {"0.5": 0.05, "1": 0.1},
+		"slow": {"0.5": 50, "1": 100},
+	} {
+		testutil.Equals(t, len(exp), len(got[target]))
+		for q, v := range exp {
+			testutil.Assert(t, math.Abs(got[target][q]-v) <= v*0.01, "target %v quantile %v: expected %v, got %v", target, q, v, got[target][q])
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/pkg/errors"
+)
+
+// result represents outcome of single ping.
+type result struct {
+	target  string
+	start   time.Time
+	latency time.Duration
+	// code is HTTP status code of the response or exthttp.CodeError if the round trip failed without response.
+	code string
+	// reason is set only if the round trip failed.
+	reason  string
+	version string
+	header  http.Header
+	body    []byte
+}
+
+func (r result) failed() bool {
+	return r.reason != "" || strings.HasPrefix(r.code, "5")
+}
+
+type stats struct {
+	requests  int
+	errors    int
+	latencies *hdrhistogram.Histogram
+}
+
+func newStats() *stats {
+	return &stats{latencies: newHDRHistogram()}
+}
+
+func (s *stats) add(r result) {
+	s.requests++
+	if r.failed() {
+		s.errors++
+	}
+	recordLatency(s.latencies, r.latency)
+}
+
+func (s *stats) summary() statsSummary {
+	sum := statsSummary{Requests: s.requests, Errors: s.errors}
+	if s.requests > 0 {
+		sum.ErrorRate = float64(s.errors) / float64(s.requests)
+	}
+	sum.Latency = latencySummary{
+		P50: latencyAtQuantile(s.latencies, 0.5).Seconds(),
+		P90: latencyAtQuantile(s.latencies, 0.9).Seconds(),
+		P99: latencyAtQuantile(s.latencies, 0.99).Seconds(),
+		Max: maxLatency(s.latencies).Seconds(),
+	}
+	return sum
+}
+
+// loadTestRecorder gathers results of bounded load test, so we can report them at the end.
+type loadTestRecorder struct {
+	mu sync.Mutex
+
+	total    *stats
+	codes    map[string]int
+	targets  map[string]*stats
+	versions map[string]*stats
+}
+
+func newLoadTestRecorder() *loadTestRecorder {
+	return &loadTestRecorder{total: newStats(), codes: map[string]int{}, targets: map[string]*stats{}, versions: map[string]*stats{}}
+}
+
+func (l *loadTestRecorder) observe(r result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total.add(r)
+	l.codes[r.code]++
+
+	if _, ok := l.targets[r.target]; !ok {
+		l.targets[r.target] = newStats()
+	}
+	l.targets[r.target].add(r)
+
+	v := r.version
+	if v == "" {
+		v = "unknown"
+	}
+	if _, ok := l.versions[v]; !ok {
+		l.versions[v] = newStats()
+	}
+	l.versions[v].add(r)
+}
+
+type latencySummary struct {
+	P50 float64 `json:"p50_seconds"`
+	P90 float64 `json:"p90_seconds"`
+	P99 float64 `json:"p99_seconds"`
+	Max float64 `json:"max_seconds"`
+}
+
+type statsSummary struct {
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"error_rate"`
+	Latency   latencySummary `json:"latency"`
+}
+
+type thresholdResult struct {
+	Threshold string  `json:"threshold"`
+	Value     float64 `json:"value"`
+	Passed    bool    `json:"passed"`
+}
+
+type loadTestReport struct {
+	statsSummary
+
+	DurationSeconds float64                 `json:"duration_seconds"`
+	Throughput      float64                 `json:"throughput"`
+	Codes           map[string]int          `json:"codes"`
+	Targets         map[string]statsSummary `json:"targets"`
+	Versions        map[string]statsSummary `json:"versions"`
+	Thresholds      []thresholdResult       `json:"thresholds"`
+	Passed          bool                    `json:"passed"`
+}
+
+func (l *loadTestRecorder) report(took time.Duration, thresholds []threshold) loadTestReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := loadTestReport{
+		statsSummary:    l.total.summary(),
+		DurationSeconds: took.Seconds(),
+		Codes:           map[string]int{},
+		Targets:         map[string]statsSummary{},
+		Versions:        map[string]statsSummary{},
+		Passed:          true,
+	}
+	if took > 0 {
+		r.Throughput = float64(r.Requests) / took.Seconds()
+	}
+	for c, n := range l.codes {
+		r.Codes[c] = n
+	}
+	for t, s := range l.targets {
+		r.Targets[t] = s.summary()
+	}
+	for v, s := range l.versions {
+		r.Versions[v] = s.summary()
+	}
+	for _, t := range thresholds {
+		tr := t.check(r)
+		r.Passed = r.Passed && tr.Passed
+		r.Thresholds = append(r.Thresholds, tr)
+	}
+	// Nothing was tested e.g target was used only by journeys or context was canceled right away.
+	r.Passed = r.Passed && r.Requests > 0
+	return r
+}
+
+func (r loadTestReport) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "Duration:\t%v\n", time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+	_, _ = fmt.Fprintf(tw, "Requests:\t%d (%.2f/s)\n", r.Requests, r.Throughput)
+	_, _ = fmt.Fprintf(tw, "Errors:\t%d (%.2f%%)\n", r.Errors, 100*r.ErrorRate)
+	_, _ = fmt.Fprintf(tw, "Latency:\t%s\n", r.Latency)
+
+	_, _ = fmt.Fprintln(tw, "\nStatus\tRequests")
+	for _, c := range sortedKeys(r.Codes) {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\n", c, r.Codes[c])
+	}
+
+	writeSummaries(tw, "Target", r.Targets)
+	writeSummaries(tw, "Version", r.Versions)
+
+	if len(r.Thresholds) > 0 {
+		_, _ = fmt.Fprintln(tw, "\nThreshold\tValue\tResult")
+		for _, t := range r.Thresholds {
+			verdict := "PASS"
+			if !t.Passed {
+				verdict = "FAIL"
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%v\t%s\n", t.Threshold, t.Value, verdict)
+		}
+	}
+	verdict := "PASSED"
+	if !r.Passed {
+		verdict = "FAILED"
+	}
+	_, _ = fmt.Fprintf(tw, "\nVerdict:\t%s\n", verdict)
+	return tw.Flush()
+}
+
+func writeSummaries(w io.Writer, by string, summaries map[string]statsSummary) {
+	_, _ = fmt.Fprintf(w, "\n%s\tRequests\tErrors\tLatency\n", by)
+	keys := make([]string, 0, len(summaries))
+	for k := range summaries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := summaries[k]
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d (%.2f%%)\t%s\n", k, s.Requests, s.Errors, 100*s.ErrorRate, s.Latency)
+	}
+}
+
+func (r loadTestReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(r)
+}
+
+func (s latencySummary) String() string {
+	d := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second)).Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50=%v p90=%v p99=%v max=%v", d(s.P50), d(s.P90), d(s.P99), d(s.Max))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// threshold is a single pass/fail condition for load test report e.g "p99<1s" or "error_rate<=0.05".
+type threshold struct {
+	expr  string
+	value func(loadTestReport) float64
+	cmp   func(a, b float64) bool
+	limit float64
+}
+
+func (t threshold) check(r loadTestReport) thresholdResult {
+	v := t.value(r)
+	return thresholdResult{Threshold: t.expr, Value: v, Passed: t.cmp(v, t.limit)}
+}
+
+var thresholdValues = map[string]func(loadTestReport) float64{
+	"p50":        func(r loadTestReport) float64 { return r.Latency.P50 },
+	"p90":        func(r loadTestReport) float64 { return r.Latency.P90 },
+	"p99":        func(r loadTestReport) float64 { return r.Latency.P99 },
+	"max":        func(r loadTestReport) float64 { return r.Latency.Max },
+	"error_rate": func(r loadTestReport) float64 { return r.ErrorRate },
+	"throughput": func(r loadTestReport) float64 { return r.Throughput },
+}
+
+// Longer operators first, so "<=" is not parsed as "<".
+var thresholdOperators = []struct {
+	op  string
+	cmp func(a, b float64) bool
+}{
+	{op: "<=", cmp: func(a, b float64) bool { return a <= b }},
+	{op: ">=", cmp: func(a, b float64) bool { return a >= b }},
+	{op: "<", cmp: func(a, b float64) bool { return a < b }},
+	{op: ">", cmp: func(a, b float64) bool { return a > b }},
+}
+
+// parseThresholds parses thresholds in format as: <metric><operator><value>,<metric><operator><value>...
+// Latency values (p50, p90, p99, max) are durations, others are plain numbers.
+func parseThresholds(encoded string) ([]threshold, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var ret []threshold
+	for _, e := range strings.Split(encoded, ",") {
+		e = strings.TrimSpace(e)
+
+		t := threshold{expr: e}
+		for _, o := range thresholdOperators {
+			if i := strings.Index(e, o.op); i > 0 {
+				name, value := e[:i], e[i+len(o.op):]
+
+				v, ok := thresholdValues[name]
+				if !ok {
+					return nil, errors.Errorf("unknown threshold metric %q in %q", name, e)
+				}
+				t.value, t.cmp = v, o.cmp
+
+				switch name {
+				case "p50", "p90", "p99", "max":
+					d, err := time.ParseDuration(value)
+					if err != nil {
+						return nil, errors.Wrapf(err, "parse threshold %v value as duration", e)
+					}
+					t.limit = d.Seconds()
+				default:
+					f, err := strconv.ParseFloat(value, 64)
+					if err != nil {
+						return nil, errors.Wrapf(err, "parse threshold %v value as float", e)
+					}
+					t.limit = f
+				}
+				break
+			}
+		}
+		if t.value == nil {
+			return nil, errors.Errorf("invalid threshold %q", e)
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
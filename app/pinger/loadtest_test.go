@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestParseThresholds(t *testing.T) {
+	report := loadTestReport{
+		statsSummary: statsSummary{
+			ErrorRate: 0.05,
+			Latency:   latencySummary{P50: 0.1, P90: 0.5, P99: 1, Max: 2},
+		},
+		Throughput: 10,
+	}
+
+	for _, tcase := range []struct {
+		encoded string
+
+		expErr    bool
+		expValues []float64
+		expPassed []bool
+	}{
+		{encoded: ""},
+		{
+			encoded:   "p99<1s, p99<=1s,p50<200ms,max>=2s",
+			expValues: []float64{1, 1, 0.1, 2},
+			expPassed: []bool{false, true, true, true},
+		},
+		{
+			encoded:   "error_rate<=0.05,error_rate<0.05,throughput>9.5,p90>1s",
+			expValues: []float64{0.05, 0.05, 10, 0.5},
+			expPassed: []bool{true, false, true, false},
+		},
+		{encoded: "p99<1", expErr: true},
+		{encoded: "error_rate<5%", expErr: true},
+		{encoded: "p95<1s", expErr: true},
+		{encoded: "p99=1s", expErr: true},
+		{encoded: "<1s", expErr: true},
+		{encoded: "p99<1s,", expErr: true},
+	} {
+		t.Run(tcase.encoded, func(t *testing.T) {
+			thresholds, err := parseThresholds(tcase.encoded)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(tcase.expValues), len(thresholds))
+
+			for i, th := range thresholds {
+				r := th.check(report)
+				testutil.Equals(t, tcase.expValues[i], r.Value, "threshold %v", r.Threshold)
+				testutil.Equals(t, tcase.expPassed[i], r.Passed, "threshold %v", r.Threshold)
+			}
+		})
+	}
+}
+
+func TestLoadTestRecorder_Report(t *testing.T) {
+	l := newLoadTestRecorder()
+	for _, r := range []result{
+		{target: "app", code: "200", version: "first", latency: 100 * time.Millisecond},
+		{target: "app", code: "200", version: "first", latency: 200 * time.Millisecond},
+		{target: "app", code: "500", version: "second", latency: 300 * time.Millisecond},
+		{target: "app", code: "error", reason: "timeout", latency: 1 * time.Second},
+		{target: "other", code: "404", version: "second", latency: 400 * time.Millisecond},
+	} {
+		l.observe(r)
+	}
+
+	thresholds, err := parseThresholds("error_rate<=0.5,max<1s")
+	testutil.Ok(t, err)
+	r := l.report(2*time.Second, thresholds)
+
+	testutil.Equals(t, 5, r.Requests)
+	testutil.Equals(t, 2, r.Errors)
+	testutil.Equals(t, 0.4, r.ErrorRate)
+	testutil.Equals(t, 2.5, r.Throughput)
+	testutil.Equals(t, map[string]int{"200": 2, "500": 1, "error": 1, "404": 1}, r.Codes)
+
+	testutil.Equals(t, 4, r.Targets["app"].Requests)
+	testutil.Equals(t, 2, r.Targets["app"].Errors)
+	testutil.Equals(t, 1, r.Targets["other"].Requests)
+	testutil.Equals(t, 0, r.Targets["other"].Errors)
+
+	// Results without version header are grouped as unknown.
+	testutil.Equals(t, 2, r.Versions["first"].Requests)
+	testutil.Equals(t, 2, r.Versions["second"].Requests)
+	testutil.Equals(t, 1, r.Versions["second"].Errors)
+	testutil.Equals(t, 1, r.Versions["unknown"].Requests)
+
+	// HDR histogram keeps 3 significant figures.
+	assertApprox(t, 0.3, r.Latency.P50)
+	assertApprox(t, 1, r.Latency.Max)
+	assertApprox(t, 0.2, r.Versions["first"].Latency.Max)
+
+	testutil.Equals(t, []thresholdResult{
+		{Threshold: "error_rate<=0.5", Value: 0.4, Passed: true},
+		{Threshold: "max<1s", Value: r.Latency.Max, Passed: false},
+	}, r.Thresholds)
+	testutil.Equals(t, false, r.Passed)
+}
+
+func TestLoadTestRecorder_ReportWithoutRequests(t *testing.T) {
+	thresholds, err := parseThresholds("error_rate<=0.5")
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		name       string
+		thresholds []threshold
+	}{
+		{name: "no thresholds"},
+		{name: "passing thresholds", thresholds: thresholds},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			r := newLoadTestRecorder().report(time.Second, tcase.thresholds)
+			testutil.Equals(t, 0, r.Requests)
+			testutil.Equals(t, false, r.Passed)
+		})
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	for _, tcase := range []struct {
+		n int
+
+		expTaken int
+	}{
+		{n: 0, expTaken: 1000},
+		{n: -1, expTaken: 1000},
+		{n: 1, expTaken: 1},
+		{n: 100, expTaken: 100},
+	} {
+		t.Run(strconv.Itoa(tcase.n), func(t *testing.T) {
+			var (
+				b     = newRequestBudget(tcase.n)
+				wg    sync.WaitGroup
+				taken int64
+			)
+			// Budget is shared by many runners at once.
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						if b.take() {
+							atomic.AddInt64(&taken, 1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			testutil.Equals(t, tcase.expTaken, int(taken))
+		})
+	}
+}
+
+func assertApprox(t *testing.T, exp, got float64) {
+	t.Helper()
+	testutil.Assert(t, math.Abs(exp-got) <= exp*0.01, "expected %v, got %v", exp, got)
+}
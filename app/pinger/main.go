@@ -4,11 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -20,6 +20,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -27,8 +30,44 @@ var (
 	addr               = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
 	endpoint           = flag.String("endpoint", "http://app.demo.svc.cluster.local:8080/ping", "The address of pong app we can connect to and send requests.")
 	pingsPerSec        = flag.Int("pings-per-second", 10, "How many pings per second we should request")
+	virtualUsers       = flag.Int("virtual-users", 0, "If positive, pinger models the given number of concurrent virtual users (closed loop) instead of fixed pings-per-second arrival rate (open loop). Each user sends a ping, waits for the response and think-time, then repeats, so throughput drops when latency rises.")
+	thinkTime          = flag.Duration("think-time", 1*time.Second, "Time virtual users wait between receiving response and sending the next ping.")
+	timeout            = flag.Duration("timeout", 5*time.Second, "Timeout of a single ping. The remaining time is propagated to the app in the "+exthttp.TimeoutHeader+" header.")
+	requestsFile       = flag.String("request-templates-file", "", "Path to YAML file with list of request templates (method, url, headers, query, body and weight) to send as a weighted mix. Values are Go templates that can generate data with randomID, int <min> <max>, float <min> <max> and pick <values...> functions. Used for targets that don't specify their own requests.")
+	configFile         = flag.String("config-file", "", "Path to YAML file with targets to ping. If empty, single 'ping' target configured by endpoint, pings-per-second, virtual-users, think-time and timeout flags is used. Those flags are defaults for targets in the file.")
 	traceEndpoint      = flag.String("trace-endpoint", "tempo.demo.svc.cluster.local:9091", "The gRPC OTLP endpoint for tracing backend. Hack: Set it to 'stdout' to print traces to the output instead")
 	traceSamplingRatio = flag.Float64("trace-sampling-ratio", 1.0, "Sampling ratio")
+
+	latencyWindow    = flag.Duration("latency.window", 1*time.Minute, "Window over which exact latency quantiles are exported as gauges and shown in the window section of /debug/latency. Has to be at least 6s.")
+	latencyQuantiles = flag.String("latency.export-quantiles", "", "Comma separated quantiles (e.g 0.5,0.9,0.99) of the high resolution latency histogram to export as pinger_request_latency_quantile_seconds gauges. Empty means no gauges.")
+
+	phaseMetrics    = flag.Bool("phase-metrics", false, "If true, durations of DNS, connect, TLS, time to first byte and body transfer phases of pings are exported as http_client_request_phase_duration_seconds histogram and added as span events.")
+	connMode        = flag.String("connections.mode", exthttp.ConnectionModePooled, "How connections to targets are managed: 'pooled' keeps reusing keep-alive connections, 'per-request' opens a new connection for every ping, 'max-age' and 'max-requests' rotate connections after connections.max-age or connections.max-requests. Long-lived connections stick to a few pods behind the Service, which skews traffic split between stable and canary.")
+	connMaxAge      = flag.Duration("connections.max-age", 30*time.Second, "Connections are rotated after this time in 'max-age' connections mode.")
+	connMaxRequests = flag.Int("connections.max-requests", 100, "Connections are rotated after this number of requests in 'max-requests' connections mode.")
+
+	retryMaxAttempts = flag.Int("retry.max-attempts", 1, "Maximum number of attempts per ping, including the first one. 1 disables retries.")
+	retryCodes       = flag.String("retry.codes", "429,502,503,504", "Comma separated HTTP status codes that should be retried.")
+	retryMinBackoff  = flag.Duration("retry.min-backoff", 25*time.Millisecond, "Initial backoff between retries. It grows exponentially with jitter up to retry.max-backoff.")
+	retryMaxBackoff  = flag.Duration("retry.max-backoff", 1*time.Second, "Maximum backoff between retries.")
+	retryBudget      = flag.Float64("retry.budget-ratio", 0.2, "Maximum ratio of extra load caused by retries, e.g 0.2 means at most 20% more requests.")
+
+	breakerEnabled             = flag.Bool("circuit-breaker.enabled", false, "If true, pings go through circuit breaker that stops sending them when the app keeps failing.")
+	breakerConsecutiveFailures = flag.Int("circuit-breaker.consecutive-failures", 5, "Number of consecutive failures that opens the circuit. 0 disables this condition.")
+	breakerFailureRatio        = flag.Float64("circuit-breaker.failure-ratio", 0.5, "Ratio of failed pings within circuit-breaker.window that opens the circuit. 0 disables this condition.")
+	breakerMinRequests         = flag.Int("circuit-breaker.min-requests", 20, "Minimum number of pings within circuit-breaker.window before failure ratio is considered.")
+	breakerWindow              = flag.Duration("circuit-breaker.window", 10*time.Second, "Window over which failure ratio is calculated.")
+	breakerOpenDuration        = flag.Duration("circuit-breaker.open-duration", 10*time.Second, "How long the circuit stays open before probes are let through.")
+	breakerHalfOpenProbes      = flag.Int("circuit-breaker.half-open-probes", 3, "Number of probes let through in half-open state. All of them have to succeed to close the circuit.")
+
+	replayFile   = flag.String("replay.file", "", "If set, pinger replays requests recorded in the given file against the target, prints the report (see load-test flags) and exits. Files with .har extension are parsed as HAR, others as JSON lines with time, method, url, headers and body fields.")
+	replaySpeed  = flag.Float64("replay.speed", 1, "Replay speed factor relative to the recorded timing, e.g 2 replays twice as fast, 0.5 twice as slow.")
+	replayTarget = flag.String("replay.target", "", "Name of the target to replay requests against. Default is the first configured target.")
+
+	loadTestDuration   = flag.Duration("load-test.duration", 0, "If set, pinger runs a bounded load test for the given duration, prints the report and exits.")
+	loadTestRequests   = flag.Int("load-test.requests", 0, "If set, pinger runs a bounded load test with the given number of requests, prints the report and exits. The number is shared by all targets, journeys and shadows. Every journey and shadow comparison takes one request.")
+	loadTestThresholds = flag.String("load-test.thresholds", "", "Load test pass/fail thresholds in format as: <metric><operator><value>,... e.g 'p99<1s,error_rate<0.05'. Supported metrics: p50, p90, p99, max, error_rate, throughput. If any is breached, pinger exits with non-zero code.")
+	loadTestJSONReport = flag.String("load-test.json-report", "", "Path to the file where load test report should be written as JSON. Use '-' to print it to the output.")
 )
 
 func main() {
@@ -40,6 +79,38 @@ func main() {
 }
 
 func runMain() (err error) {
+	thresholds, err := parseThresholds(*loadTestThresholds)
+	if err != nil {
+		return err
+	}
+	quantiles, err := parseQuantiles(*latencyQuantiles)
+	if err != nil {
+		return err
+	}
+	if *latencyWindow < minLatencyWindow {
+		return errors.Errorf("latency.window has to be at least %v, got %v", minLatencyWindow, *latencyWindow)
+	}
+	codes, err := parseStatusCodes(*retryCodes)
+	if err != nil {
+		return err
+	}
+	templates, err := loadRequestTemplates(*requestsFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*configFile, targetConfig{
+		Name:           "ping",
+		Endpoint:       *endpoint,
+		PingsPerSecond: pingsPerSec,
+		VirtualUsers:   virtualUsers,
+		ThinkTime:      model.Duration(*thinkTime),
+		Timeout:        model.Duration(*timeout),
+		Requests:       templates,
+	})
+	if err != nil {
+		return err
+	}
+
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(
 		prometheus.NewGoCollector(),
@@ -70,16 +141,154 @@ func runMain() (err error) {
 		fmt.Println("Tracing enabled", *traceEndpoint)
 	}
 
-	instr := exthttp.NewInstrumentationMiddleware(reg, nil, nil)
+	var instrOpts []exthttp.InstrumentationOption
+	if *phaseMetrics {
+		instrOpts = append(instrOpts, exthttp.WithPhaseMetrics(nil))
+	}
+	var (
+		// Retry budget is shared by all targets, instrumentation and circuit breakers are per target.
+		instrTripperware = exthttp.NewInstrumentationTripperware(reg, tracingProvider, instrOpts...)
+		retryTripperware = exthttp.NewRetryTripperware(reg, tracingProvider,
+			exthttp.WithRetryMaxAttempts(*retryMaxAttempts),
+			exthttp.WithRetryableCodes(codes...),
+			exthttp.WithRetryBackoff(*retryMinBackoff, *retryMaxBackoff),
+			exthttp.WithRetryBudget(*retryBudget, 10),
+		)
+		breakerTripperware exthttp.Tripperware
+		connTripperware    = exthttp.NewConnectionReuseTripperware(reg)
+		targets            []*pingTarget
+	)
+	if *breakerEnabled {
+		breakerTripperware, err = exthttp.NewCircuitBreakerTripperware(reg,
+			exthttp.WithBreakerConsecutiveFailures(*breakerConsecutiveFailures),
+			exthttp.WithBreakerFailureRatio(*breakerFailureRatio, *breakerMinRequests, *breakerWindow),
+			exthttp.WithBreakerOpenDuration(*breakerOpenDuration),
+			exthttp.WithBreakerHalfOpenProbes(*breakerHalfOpenProbes),
+		)
+		if err != nil {
+			return errors.Wrap(err, "circuit breaker")
+		}
+	}
+	for _, tcfg := range cfg.Targets {
+		transport, err := exthttp.NewTransport(*connMode,
+			exthttp.WithConnectionMaxAge(*connMaxAge),
+			exthttp.WithConnectionMaxRequests(*connMaxRequests),
+		)
+		if err != nil {
+			return err
+		}
+		// Right above the transport, so every attempt propagates what is left from ping timeout, after previous
+		// attempts and backoffs.
+		transport = exthttp.NewDeadlineTripperware().WrapRoundTripper(tcfg.Name, transport)
+		if tcfg.Faults != nil {
+			// Right above deadline propagation, so every attempt is affected and the app gets the time left after
+			// injected latency.
+			transport = exthttp.NewFaultInjectionTripperware(reg, tcfg.Faults.options()...).WrapRoundTripper(tcfg.Name, transport)
+		}
+		// Track connection reuse of every attempt.
+		transport = connTripperware.WrapRoundTripper(tcfg.Name, transport)
+		if tcfg.Assertions != nil {
+			validate, err := tcfg.Assertions.validator()
+			if err != nil {
+				return errors.Wrapf(err, "target %v assertions", tcfg.Name)
+			}
+			// Below retries and circuit breaker, so every attempt is validated and invalid responses count as failures.
+			// Instrumentation counts them with their status code and own reason.
+			transport = exthttp.NewResponseValidationTripperware(validate).WrapRoundTripper(tcfg.Name, transport)
+		}
+		if *retryMaxAttempts > 1 {
+			// Retries are below instrumentation, so http_client_requests_total shows what user sees after retries,
+			// and http_client_request_attempts_total shows the real load.
+			transport = retryTripperware.WrapRoundTripper(tcfg.Name, transport)
+		}
+		if breakerTripperware != nil {
+			transport = breakerTripperware.WrapRoundTripper(tcfg.Name, transport)
+		}
+
+		mix, err := newRequestMix(tcfg.Requests)
+		if err != nil {
+			return errors.Wrapf(err, "target %v", tcfg.Name)
+		}
+		targets = append(targets, &pingTarget{
+			targetConfig: tcfg,
+			requests:     mix,
+			client: &http.Client{
+				// Custom HTTP client with metrics and tracing instrumentation.
+				Transport: instrTripperware.WrapRoundTripper(tcfg.Name, transport),
+			},
+			latencies:   newLatencyRecorder(reg, tcfg.Name, *latencyWindow, quantiles),
+			activeUsers: newActiveUsersGauge(reg, tcfg),
+		})
+	}
+
+	var tp trace.TracerProvider
+	if tracingProvider != nil {
+		tp = tracingProvider
+	}
+	var (
+		journeys       []*journey
+		journeyMetrics = newJourneyMetrics(reg)
+	)
+	for _, jcfg := range cfg.Journeys {
+		t, err := findTarget(targets, jcfg.Target)
+		if err != nil {
+			return err
+		}
+		j, err := newJourney(jcfg, t, tp, journeyMetrics)
+		if err != nil {
+			return err
+		}
+		journeys = append(journeys, j)
+	}
+
+	var (
+		shadows       []*shadow
+		shadowMetrics = newShadowMetrics(reg)
+	)
+	for _, scfg := range cfg.Shadows {
+		primary, err := findTarget(targets, scfg.Primary)
+		if err != nil {
+			return err
+		}
+		shadowTarget, err := findTarget(targets, scfg.Shadow)
+		if err != nil {
+			return err
+		}
+		shadows = append(shadows, newShadow(scfg, primary, shadowTarget, tp, shadowMetrics))
+	}
+
+	var (
+		probers      []*instanceProber
+		probeMetrics = newProbeMetrics(reg)
+	)
+	for _, t := range targets {
+		if t.Discovery == nil {
+			continue
+		}
+		// Probes go to instances directly without retries and circuit breaker, so they show health of every instance.
+		var transport http.RoundTripper = exthttp.NewDeadlineTripperware().WrapRoundTripper(t.Name, http.DefaultTransport)
+		if tracingProvider != nil {
+			transport = otelhttp.NewTransport(transport, otelhttp.WithTracerProvider(tracingProvider), otelhttp.WithPropagators(tracingProvider))
+		}
+		p, err := newInstanceProber(t, &http.Client{Transport: transport}, probeMetrics)
+		if err != nil {
+			return err
+		}
+		probers = append(probers, p)
+	}
+
 	m := http.NewServeMux()
-	m.Handle("/metrics", instr.WrapHandler("/metrics", promhttp.HandlerFor(
+	m.Handle("/metrics", promhttp.HandlerFor(
 		reg,
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
-	)))
-	srv := http.Server{Addr: *addr, Handler: m}
+	))
+	m.Handle("/debug/latency", latencyHandler(targets))
+	m.Handle("/debug/shadow", shadowMetrics.samplesHandler())
+	// All routes are instrumented with matched pattern as handler label.
+	srv := http.Server{Addr: *addr, Handler: exthttp.InstrumentRoutes(exthttp.NewInstrumentationMiddleware(reg, nil), m)}
 
 	g := &run.Group{}
 	g.Add(func() error {
@@ -93,61 +302,160 @@ func runMain() (err error) {
 			fmt.Println("Failed to stop web server:", err)
 		}
 	})
-	{
-		client := &http.Client{
-			// Custom HTTP client with metrics and tracing instrumentation.
-			Transport: exthttp.NewInstrumentationTripperware(reg, nil, tracingProvider).
-				WrapRoundTripper("ping", http.DefaultTransport),
-		}
-
+	for _, t := range targets {
+		t := t
+		done := make(chan struct{})
+		g.Add(func() error {
+			t.latencies.rotate(done)
+			return nil
+		}, func(error) {
+			close(done)
+		})
+	}
+	for _, p := range probers {
+		p := p
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			spamPings(ctx, client, *endpoint, *pingsPerSec)
+			p.run(ctx)
 			return nil
 		}, func(error) {
 			cancel()
 		})
 	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		switch {
+		case *replayFile != "":
+			reqs, err := loadRecording(*replayFile)
+			if err != nil {
+				cancel()
+				return err
+			}
+			if *replaySpeed <= 0 {
+				cancel()
+				return errors.Errorf("replay speed has to be positive, got %v", *replaySpeed)
+			}
+			t, err := findTarget(targets, *replayTarget)
+			if err != nil {
+				cancel()
+				return err
+			}
+			fmt.Printf("Replaying %d requests against target %v with %vx speed\n", len(reqs), t.Name, *replaySpeed)
+			g.Add(func() error {
+				return runBounded(thresholds, func(observe func(result)) {
+					replay(ctx, t, reqs, *replaySpeed, observe)
+				})
+			}, func(error) {
+				cancel()
+			})
+		case *loadTestDuration != 0 || *loadTestRequests != 0:
+			g.Add(func() error {
+				return runBounded(thresholds, func(observe func(result)) {
+					runAll(ctx, targets, journeys, shadows, spamLimits{requests: newRequestBudget(*loadTestRequests), duration: *loadTestDuration}, observe)
+				})
+			}, func(error) {
+				cancel()
+			})
+		default:
+			g.Add(func() error {
+				runAll(ctx, targets, journeys, shadows, spamLimits{}, func(result) {})
+				// Wait for interrupt, even if there was nothing to run.
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
 	g.Add(run.SignalHandler(context.Background(), syscall.SIGINT, syscall.SIGTERM))
 	return g.Run()
 }
 
-func spamPings(ctx context.Context, client *http.Client, endpoint string, pingsPerSec int) {
-	var wg sync.WaitGroup
-	for {
-		select {
-		case <-ctx.Done():
-			wg.Wait()
-			return
-		case <-time.After(1 * time.Second):
-		}
+// runBounded runs given traffic until it finishes and reports results. It returns error if any threshold is breached
+// or no request was sent.
+func runBounded(thresholds []threshold, traffic func(observe func(result))) error {
+	rec := newLoadTestRecorder()
+	start := time.Now()
+	traffic(rec.observe)
+	rep := rec.report(time.Since(start), thresholds)
 
-		for i := 0; i < pingsPerSec; i++ {
-			wg.Add(1)
-			go ping(ctx, client, endpoint, &wg)
+	if err := rep.writeText(os.Stdout); err != nil {
+		return errors.Wrap(err, "write report")
+	}
+	switch *loadTestJSONReport {
+	case "":
+	case "-":
+		if err := rep.writeJSON(os.Stdout); err != nil {
+			return errors.Wrap(err, "write JSON report")
+		}
+	default:
+		f, err := os.Create(*loadTestJSONReport)
+		if err != nil {
+			return errors.Wrap(err, "create JSON report file")
+		}
+		if err := rep.writeJSON(f); err != nil {
+			_ = f.Close()
+			return errors.Wrap(err, "write JSON report")
+		}
+		if err := f.Close(); err != nil {
+			return errors.Wrap(err, "close JSON report file")
 		}
 	}
-}
 
-func ping(ctx context.Context, client *http.Client, endpoint string, wg *sync.WaitGroup) {
-	defer wg.Done()
+	if rep.Requests == 0 {
+		return errors.New("load test sent no requests")
+	}
+	if !rep.Passed {
+		return errors.New("load test thresholds breached")
+	}
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+// runAll spams all targets, runs all journeys and shadow traffic at once and waits until all of them finish.
+func runAll(ctx context.Context, targets []*pingTarget, journeys []*journey, shadows []*shadow, limits spamLimits, observe func(result)) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		spamAll(ctx, targets, limits, observe)
+	}()
+	go func() {
+		defer wg.Done()
+		runJourneys(ctx, journeys, limits, observe)
+	}()
+	go func() {
+		defer wg.Done()
+		runShadows(ctx, shadows, limits, observe)
+	}()
+	wg.Wait()
+}
 
-	r, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
-	if err != nil {
-		fmt.Println("Failed to create request:", err)
-		return
+// findTarget returns target with the given name or the first one if name is empty.
+func findTarget(targets []*pingTarget, name string) (*pingTarget, error) {
+	if name == "" {
+		return targets[0], nil
 	}
-	res, err := client.Do(r)
-	if err != nil {
-		fmt.Println("Failed to send request:", err)
-		return
+	for _, t := range targets {
+		if t.Name == name {
+			return t, nil
+		}
 	}
-	if res.Body != nil {
-		// We don't care about response, just release resources.
-		_, _ = io.Copy(ioutil.Discard, res.Body)
-		_ = res.Body.Close()
+	return nil, errors.Errorf("target %q not found", name)
+}
+
+// parseStatusCodes parses comma separated HTTP status codes e.g "502,503".
+func parseStatusCodes(encoded string) ([]int, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var ret []int
+	for _, e := range strings.Split(encoded, ",") {
+		c, err := strconv.Atoi(strings.TrimSpace(e))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse status code %v as int", e)
+		}
+		ret = append(ret, c)
 	}
+	return ret, nil
 }
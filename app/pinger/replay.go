@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// recordedRequest is a single request read from the recorded access log.
+type recordedRequest struct {
+	// at is the time when request was recorded.
+	at     time.Time
+	method string
+	url    *url.URL
+	header http.Header
+	body   []byte
+}
+
+// jsonLogEntry is the format of JSON lines recording. Only time and url are required.
+type jsonLogEntry struct {
+	Time    time.Time         `json:"time"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// harLog is the subset of HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/) we need for replay.
+type harLog struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// Headers that are connection specific or set by the client itself, so they are not replayed.
+var skippedReplayHeaders = map[string]struct{}{
+	"Host":              {},
+	"Content-Length":    {},
+	"Connection":        {},
+	"Accept-Encoding":   {},
+	"Transfer-Encoding": {},
+	"Traceparent":       {},
+	"Tracestate":        {},
+}
+
+func newRecordedRequest(t time.Time, method, rawURL string, body string) (recordedRequest, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return recordedRequest{}, errors.Wrapf(err, "parse URL %v", rawURL)
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	return recordedRequest{at: t, method: method, url: u, header: http.Header{}, body: []byte(body)}, nil
+}
+
+func (r *recordedRequest) addHeader(name, value string) {
+	name = http.CanonicalHeaderKey(name)
+	if _, ok := skippedReplayHeaders[name]; ok || strings.HasPrefix(name, ":") {
+		return
+	}
+	r.header.Add(name, value)
+}
+
+// loadRecording reads recorded requests from HAR file (.har extension) or JSON lines file (anything else)
+// and returns them sorted by time.
+func loadRecording(path string) ([]recordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open recording %v", path)
+	}
+	defer func() { _ = f.Close() }()
+
+	var reqs []recordedRequest
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		reqs, err = parseHAR(f)
+	} else {
+		reqs, err = parseJSONLines(f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse recording %v", path)
+	}
+	if len(reqs) == 0 {
+		return nil, errors.Errorf("no requests found in recording %v", path)
+	}
+
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].at.Before(reqs[j].at) })
+	return reqs, nil
+}
+
+func parseHAR(r io.Reader) ([]recordedRequest, error) {
+	var h harLog
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+
+	reqs := make([]recordedRequest, 0, len(h.Log.Entries))
+	for _, e := range h.Log.Entries {
+		body := ""
+		if e.Request.PostData != nil {
+			body = e.Request.PostData.Text
+		}
+		rr, err := newRecordedRequest(e.StartedDateTime, e.Request.Method, e.Request.URL, body)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range e.Request.Headers {
+			rr.addHeader(h.Name, h.Value)
+		}
+		reqs = append(reqs, rr)
+	}
+	return reqs, nil
+}
+
+func parseJSONLines(r io.Reader) ([]recordedRequest, error) {
+	var reqs []recordedRequest
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		var e jsonLogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		rr, err := newRecordedRequest(e.Time, e.Method, e.URL, e.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		for k, v := range e.Headers {
+			rr.addHeader(k, v)
+		}
+		reqs = append(reqs, rr)
+	}
+	return reqs, s.Err()
+}
+
+// newRequest recreates recorded request against the given endpoint. Path, query, method, headers and body
+// are preserved, scheme and host are taken from the endpoint.
+func (r recordedRequest) newRequest(ctx context.Context, endpoint string) (*http.Request, error) {
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint %v", endpoint)
+	}
+	u := *r.url
+	u.Scheme, u.Host, u.User = e.Scheme, e.Host, e.User
+
+	var body io.Reader
+	if len(r.body) > 0 {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.header.Clone()
+	return req, nil
+}
+
+// replay sends recorded requests to the target keeping the original gaps between them divided by speed,
+// e.g speed 2 replays twice as fast. Requests are not waiting for previous responses, same as real traffic.
+// It returns once all requests finished.
+func replay(ctx context.Context, t *pingTarget, reqs []recordedRequest, speed float64, observe func(result)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	start := time.Now()
+	first := reqs[0].at
+	for _, rr := range reqs {
+		rr := rr
+
+		at := start.Add(time.Duration(float64(rr.at.Sub(first)) / speed))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(at)):
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, ok := t.send(ctx, t.client, func(ctx context.Context) (*http.Request, error) {
+				return rr.newRequest(ctx, t.Endpoint)
+			}); ok {
+				t.latencies.observe(r)
+				observe(r)
+			}
+		}()
+	}
+}
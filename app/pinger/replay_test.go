@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+// simplifiedRequest is recordedRequest with comparable fields.
+type simplifiedRequest struct {
+	at     time.Time
+	method string
+	url    string
+	header http.Header
+	body   string
+}
+
+func simplify(reqs []recordedRequest) []simplifiedRequest {
+	var ret []simplifiedRequest
+	for _, r := range reqs {
+		ret = append(ret, simplifiedRequest{at: r.at, method: r.method, url: r.url.String(), header: r.header, body: string(r.body)})
+	}
+	return ret
+}
+
+func TestParseHAR(t *testing.T) {
+	at := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, tcase := range []struct {
+		name    string
+		encoded string
+
+		expErr  bool
+		expReqs []simplifiedRequest
+	}{
+		{name: "invalid JSON", encoded: `{"log":`, expErr: true},
+		{name: "no entries", encoded: `{"log":{"entries":[]}}`},
+		{name: "invalid URL", encoded: `{"log":{"entries":[{"request":{"url":"http://a b/%zz"}}]}}`, expErr: true},
+		{
+			name: "entries",
+			encoded: `{"log":{"entries":[
+	{"startedDateTime":"2021-05-01T10:00:00Z","request":{"method":"POST","url":"http://app/ping?x=1",
+		"headers":[{"name":"content-type","value":"application/json"},{"name":"Host","value":"app"},{"name":":authority","value":"app"},{"name":"traceparent","value":"00-1"}],
+		"postData":{"text":"{}"}}},
+	{"startedDateTime":"2021-05-01T10:00:01Z","request":{"url":"http://app/ping"}}
+]}}`,
+			expReqs: []simplifiedRequest{
+				{at: at, method: "POST", url: "http://app/ping?x=1", header: http.Header{"Content-Type": []string{"application/json"}}, body: "{}"},
+				{at: at.Add(1 * time.Second), method: "GET", url: "http://app/ping", header: http.Header{}},
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reqs, err := parseHAR(strings.NewReader(tcase.encoded))
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expReqs, simplify(reqs))
+		})
+	}
+}
+
+func TestParseJSONLines(t *testing.T) {
+	at := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, tcase := range []struct {
+		name    string
+		encoded string
+
+		expErr  bool
+		expReqs []simplifiedRequest
+	}{
+		{name: "empty"},
+		{name: "invalid JSON", encoded: "{\"url\":\"http://app/ping\"}\n{", expErr: true},
+		{name: "invalid URL", encoded: `{"url":"http://a b/%zz"}`, expErr: true},
+		{
+			name: "lines",
+			encoded: `{"time":"2021-05-01T10:00:01Z","url":"/ping","headers":{"x-user":"1","connection":"close"}}
+
+{"time":"2021-05-01T10:00:00Z","method":"PUT","url":"http://app/ping","body":"a"}
+`,
+			expReqs: []simplifiedRequest{
+				{at: at.Add(1 * time.Second), method: "GET", url: "/ping", header: http.Header{"X-User": []string{"1"}}},
+				{at: at, method: "PUT", url: "http://app/ping", header: http.Header{}, body: "a"},
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reqs, err := parseJSONLines(strings.NewReader(tcase.encoded))
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expReqs, simplify(reqs))
+		})
+	}
+}
+
+func TestRecordedRequest_NewRequest(t *testing.T) {
+	rr, err := newRecordedRequest(time.Time{}, "POST", "http://recorded:80/ping?x=1", "body")
+	testutil.Ok(t, err)
+	rr.addHeader("x-user", "1")
+
+	req, err := rr.newRequest(context.Background(), "https://app:8080")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "https://app:8080/ping?x=1", req.URL.String())
+	testutil.Equals(t, "1", req.Header.Get("X-User"))
+
+	// Request must not share headers with the recording.
+	req.Header.Set("X-User", "2")
+	testutil.Equals(t, "1", rr.header.Get("X-User"))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Body comparison modes of shadow traffic.
+const (
+	bodyCompareExact = "exact"
+	bodyCompareJSON  = "json"
+	bodyCompareNone  = "none"
+)
+
+// Compared parts of responses, used as "field" label of mismatch metric.
+const (
+	mismatchStatus = "status"
+	mismatchHeader = "header"
+	mismatchBody   = "body"
+)
+
+// shadowConfig describes shadow traffic: every request is sent to both primary and shadow target (e.g stable and
+// canary Service) and responses are compared, so functional regressions that don't affect latency or errors are caught.
+type shadowConfig struct {
+	Name string `yaml:"name"`
+	// Primary target generates requests from its templates. Path and query are kept for the shadow target,
+	// only scheme and host are taken from its endpoint.
+	Primary string `yaml:"primary"`
+	Shadow  string `yaml:"shadow"`
+	// PerSecond is the number of requests sent to both targets every second. Default is 1.
+	PerSecond float64 `yaml:"per_second"`
+	// Headers to compare. Status code is always compared.
+	Headers []string `yaml:"headers"`
+	// Body comparison: "exact" (default), "json" for field-level comparison or "none".
+	Body string `yaml:"body"`
+	// IgnoreFields are JSON paths in dot notation (e.g "meta.timestamp") ignored in "json" body comparison.
+	IgnoreFields []string `yaml:"ignore_fields"`
+}
+
+// mismatchSample is a single response difference, exposed on /debug/shadow.
+type mismatchSample struct {
+	Time       time.Time `json:"time"`
+	Shadow     string    `json:"shadow"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Mismatches []string  `json:"mismatches"`
+}
+
+// maxMismatchSamples is the number of the latest mismatch samples kept.
+const maxMismatchSamples = 50
+
+// maxMismatchesPerSample bounds the number of differences reported for single comparison, e.g for completely different JSON.
+const maxMismatchesPerSample = 10
+
+type shadowMetrics struct {
+	comparisons *prometheus.CounterVec
+	mismatches  *prometheus.CounterVec
+
+	mu      sync.Mutex
+	samples []mismatchSample
+}
+
+func newShadowMetrics(reg prometheus.Registerer) *shadowMetrics {
+	return &shadowMetrics{
+		comparisons: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_shadow_comparisons_total",
+			Help: "Tracks the number of responses of primary and shadow targets compared.",
+		}, []string{"shadow"}),
+		mismatches: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "pinger_shadow_mismatches_total",
+			Help: "Tracks the number of comparisons where responses of primary and shadow targets differ in the given field.",
+		}, []string{"shadow", "field"}),
+	}
+}
+
+func (m *shadowMetrics) addSample(s mismatchSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = append(m.samples, s)
+	if len(m.samples) > maxMismatchSamples {
+		m.samples = m.samples[len(m.samples)-maxMismatchSamples:]
+	}
+}
+
+// samplesHandler returns the latest mismatch samples as JSON, newest first.
+func (m *shadowMetrics) samplesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		m.mu.Lock()
+		samples := make([]mismatchSample, 0, len(m.samples))
+		for i := len(m.samples) - 1; i >= 0; i-- {
+			samples = append(samples, m.samples[i])
+		}
+		m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(samples)
+	})
+}
+
+type shadow struct {
+	shadowConfig
+
+	primary, shadow *pingTarget
+	tracer          trace.Tracer
+	ignore          map[string]struct{}
+	metrics         *shadowMetrics
+}
+
+func newShadow(cfg shadowConfig, primary, shadowTarget *pingTarget, tp trace.TracerProvider, m *shadowMetrics) *shadow {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	ignore := map[string]struct{}{}
+	for _, f := range cfg.IgnoreFields {
+		ignore[f] = struct{}{}
+	}
+	for _, f := range []string{mismatchStatus, mismatchHeader, mismatchBody} {
+		m.mismatches.WithLabelValues(cfg.Name, f)
+	}
+	return &shadow{
+		shadowConfig: cfg,
+		primary:      primary,
+		shadow:       shadowTarget,
+		tracer:       tp.Tracer("pinger"),
+		ignore:       ignore,
+		metrics:      m,
+	}
+}
+
+// runShadows sends shadow traffic until context is canceled or limits are reached. It waits for all requests
+// to finish before returning.
+func runShadows(ctx context.Context, shadows []*shadow, limits spamLimits, observe func(result)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, s := range shadows {
+		wg.Add(1)
+		go func(s *shadow) {
+			defer wg.Done()
+			spamAtRate(ctx, s.PerSecond, limits, func() {
+				s.run(ctx, observe)
+			})
+		}(s)
+	}
+}
+
+// run sends the same request to both targets in one trace and compares responses.
+func (s *shadow) run(ctx context.Context, observe func(result)) {
+	ctx, span := s.tracer.Start(ctx, "shadow "+s.Name, trace.WithNewRoot())
+	defer span.End()
+
+	rr, err := s.newRecordedRequest(ctx)
+	if err != nil {
+		fmt.Println("Failed to create shadow request:", err)
+		return
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results [2]result
+		sent    [2]bool
+	)
+	for i, t := range []*pingTarget{s.primary, s.shadow} {
+		wg.Add(1)
+		go func(i int, t *pingTarget) {
+			defer wg.Done()
+			results[i], sent[i] = t.send(ctx, t.client, func(ctx context.Context) (*http.Request, error) {
+				return rr.newRequest(ctx, t.Endpoint)
+			})
+			if sent[i] {
+				t.latencies.observe(results[i])
+				observe(results[i])
+			}
+		}(i, t)
+	}
+	wg.Wait()
+	if !sent[0] || !sent[1] {
+		return
+	}
+
+	s.metrics.comparisons.WithLabelValues(s.Name).Inc()
+	diffs := s.compare(results[0], results[1])
+	if len(diffs) == 0 {
+		span.SetAttributes(attribute.Bool("mismatch", false))
+		return
+	}
+
+	var (
+		fields     []string
+		mismatches []string
+	)
+	for f, d := range diffs {
+		fields = append(fields, f)
+		mismatches = append(mismatches, d...)
+		s.metrics.mismatches.WithLabelValues(s.Name, f).Inc()
+	}
+	sort.Strings(fields)
+	sort.Strings(mismatches)
+	span.SetAttributes(attribute.Bool("mismatch", true), attribute.Array("mismatch.fields", fields))
+
+	sample := mismatchSample{Time: time.Now(), Shadow: s.Name, Method: rr.method, URL: rr.url.String(), Mismatches: mismatches}
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		sample.TraceID = sc.TraceID().String()
+	}
+	s.metrics.addSample(sample)
+}
+
+// newRecordedRequest generates request from the primary target, so exactly the same request can be sent to both targets.
+func (s *shadow) newRecordedRequest(ctx context.Context) (recordedRequest, error) {
+	req, err := s.primary.newRequest(ctx)
+	if err != nil {
+		return recordedRequest{}, err
+	}
+	rr := recordedRequest{method: req.Method, url: req.URL, header: req.Header}
+	if req.Body != nil {
+		if rr.body, err = ioutil.ReadAll(req.Body); err != nil {
+			return recordedRequest{}, errors.Wrap(err, "read request body")
+		}
+	}
+	return rr, nil
+}
+
+// compare returns differences between primary and shadow responses by compared field.
+func (s *shadow) compare(primary, shadow result) map[string][]string {
+	diffs := map[string][]string{}
+	if primary.code != shadow.code {
+		diffs[mismatchStatus] = []string{fmt.Sprintf("status: %v != %v", primary.code, shadow.code)}
+	}
+	for _, h := range s.Headers {
+		if p, sh := primary.header.Get(h), shadow.header.Get(h); p != sh {
+			diffs[mismatchHeader] = append(diffs[mismatchHeader], fmt.Sprintf("header %v: %q != %q", http.CanonicalHeaderKey(h), p, sh))
+		}
+	}
+
+	switch s.Body {
+	case bodyCompareNone:
+	case bodyCompareJSON:
+		var p, sh interface{}
+		perr, sherr := json.Unmarshal(primary.body, &p), json.Unmarshal(shadow.body, &sh)
+		if perr != nil || sherr != nil {
+			if !bytes.Equal(primary.body, shadow.body) {
+				diffs[mismatchBody] = []string{"body: not JSON and not equal"}
+			}
+			break
+		}
+		var d []string
+		s.diffJSON("", p, sh, &d)
+		if len(d) > 0 {
+			diffs[mismatchBody] = d
+		}
+	default:
+		if !bytes.Equal(primary.body, shadow.body) {
+			diffs[mismatchBody] = []string{fmt.Sprintf("body: %d bytes != %d bytes", len(primary.body), len(shadow.body))}
+		}
+	}
+	return diffs
+}
+
+// diffJSON appends paths of fields that differ between decoded JSON values, skipping ignored fields.
+func (s *shadow) diffJSON(path string, p, sh interface{}, diffs *[]string) {
+	if _, ok := s.ignore[path]; ok || len(*diffs) >= maxMismatchesPerSample {
+		return
+	}
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch pv := p.(type) {
+	case map[string]interface{}:
+		if shv, ok := sh.(map[string]interface{}); ok {
+			keys := map[string]struct{}{}
+			for k := range pv {
+				keys[k] = struct{}{}
+			}
+			for k := range shv {
+				keys[k] = struct{}{}
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				s.diffJSON(join(k), pv[k], shv[k], diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if shv, ok := sh.([]interface{}); ok && len(pv) == len(shv) {
+			for i := range pv {
+				s.diffJSON(join(strconv.Itoa(i)), pv[i], shv[i], diffs)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(p, sh) {
+		pb, _ := json.Marshal(p)
+		shb, _ := json.Marshal(sh)
+		if path == "" {
+			path = "."
+		}
+		*diffs = append(*diffs, fmt.Sprintf("body field %v: %s != %s", path, pb, shb))
+	}
+}
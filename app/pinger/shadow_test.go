@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestShadow_DiffJSON(t *testing.T) {
+	many := make([]string, 0, 2*maxMismatchesPerSample)
+	for i := 0; i < 2*maxMismatchesPerSample; i++ {
+		many = append(many, fmt.Sprintf("%q: %d", fmt.Sprintf("f%02d", i), i))
+	}
+
+	for _, tcase := range []struct {
+		name          string
+		primary       string
+		shadow        string
+		ignore        []string
+		expDiffs      []string
+		expDiffsCount int
+	}{
+		{name: "equal", primary: `{"a": 1, "b": [1, {"c": "d"}]}`, shadow: `{"b": [1, {"c": "d"}], "a": 1}`},
+		{name: "different scalar", primary: `1`, shadow: `"1"`, expDiffs: []string{`body field .: 1 != "1"`}},
+		{
+			name:    "different fields",
+			primary: `{"a": 1, "b": {"c": true}, "d": "x"}`,
+			shadow:  `{"a": 2, "b": {"c": false}, "e": "x"}`,
+			expDiffs: []string{
+				`body field a: 1 != 2`,
+				`body field b.c: true != false`,
+				`body field d: "x" != null`,
+				`body field e: null != "x"`,
+			},
+		},
+		{
+			name:     "different array elements",
+			primary:  `{"a": [1, 2, 3]}`,
+			shadow:   `{"a": [1, 5, 3]}`,
+			expDiffs: []string{`body field a.1: 2 != 5`},
+		},
+		{
+			name:     "different array length",
+			primary:  `{"a": [1, 2]}`,
+			shadow:   `{"a": [1, 2, 3]}`,
+			expDiffs: []string{`body field a: [1,2] != [1,2,3]`},
+		},
+		{
+			name:     "different types",
+			primary:  `{"a": {"b": 1}}`,
+			shadow:   `{"a": [1]}`,
+			expDiffs: []string{`body field a: {"b":1} != [1]`},
+		},
+		{
+			name:     "ignored fields",
+			primary:  `{"meta": {"timestamp": 1, "id": 1}, "items": [{"id": 1}]}`,
+			shadow:   `{"meta": {"timestamp": 2, "id": 2}, "items": [{"id": 2}]}`,
+			ignore:   []string{"meta.timestamp", "items.0.id"},
+			expDiffs: []string{`body field meta.id: 1 != 2`},
+		},
+		{
+			name:          "bounded number of differences",
+			primary:       "{" + strings.Join(many, ",") + "}",
+			shadow:        `{}`,
+			expDiffsCount: maxMismatchesPerSample,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			s := newShadow(shadowConfig{Name: "test", IgnoreFields: tcase.ignore}, nil, nil, nil, newShadowMetrics(prometheus.NewRegistry()))
+
+			var p, sh interface{}
+			testutil.Ok(t, json.Unmarshal([]byte(tcase.primary), &p))
+			testutil.Ok(t, json.Unmarshal([]byte(tcase.shadow), &sh))
+
+			var diffs []string
+			s.diffJSON("", p, sh, &diffs)
+			if tcase.expDiffsCount > 0 {
+				testutil.Equals(t, tcase.expDiffsCount, len(diffs))
+				return
+			}
+			testutil.Equals(t, tcase.expDiffs, diffs)
+		})
+	}
+}
+
+func TestShadow_Compare(t *testing.T) {
+	primary := result{code: "200", header: http.Header{"X-Version": []string{"v1"}}, body: []byte(`{"a": 1, "t": 1}`)}
+
+	for _, tcase := range []struct {
+		name     string
+		cfg      shadowConfig
+		shadow   result
+		expDiffs map[string][]string
+	}{
+		{
+			name:     "status and headers",
+			cfg:      shadowConfig{Headers: []string{"x-version"}, Body: bodyCompareNone},
+			shadow:   result{code: "500", header: http.Header{"X-Version": []string{"v2"}}},
+			expDiffs: map[string][]string{mismatchStatus: {"status: 200 != 500"}, mismatchHeader: {`header X-Version: "v1" != "v2"`}},
+		},
+		{
+			name:     "exact body",
+			shadow:   result{code: "200", body: []byte(`{"t": 1, "a": 1}`)},
+			expDiffs: map[string][]string{mismatchBody: {"body: 16 bytes != 16 bytes"}},
+		},
+		{
+			name:     "JSON body",
+			cfg:      shadowConfig{Body: bodyCompareJSON, IgnoreFields: []string{"t"}},
+			shadow:   result{code: "200", body: []byte(`{"t": 2, "a": 1}`)},
+			expDiffs: map[string][]string{},
+		},
+		{
+			name:     "JSON body not JSON",
+			cfg:      shadowConfig{Body: bodyCompareJSON},
+			shadow:   result{code: "200", body: []byte(`not JSON`)},
+			expDiffs: map[string][]string{mismatchBody: {"body: not JSON and not equal"}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			s := newShadow(tcase.cfg, nil, nil, nil, newShadowMetrics(prometheus.NewRegistry()))
+			testutil.Equals(t, tcase.expDiffs, s.compare(primary, tcase.shadow))
+		})
+	}
+}
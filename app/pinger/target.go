@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnaisUrlichs/observe-argo-rollout/app/exthttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pingTarget is configured target with its own instrumented client and latency recorder.
+type pingTarget struct {
+	targetConfig
+
+	client      *http.Client
+	requests    *requestMix
+	latencies   *latencyRecorder
+	activeUsers prometheus.Gauge
+}
+
+// spamLimits bounds spamPings. Zero values mean no limit. Duration is applied to every target separately, while
+// requests budget is shared by everything the limits are passed to.
+type spamLimits struct {
+	requests *requestBudget
+	duration time.Duration
+}
+
+// requestBudget is the number of requests left, safe for concurrent use. Nil budget is unlimited.
+type requestBudget struct {
+	left int64
+}
+
+// newRequestBudget returns budget of n requests, or nil (unlimited) if n is not positive.
+func newRequestBudget(n int) *requestBudget {
+	if n <= 0 {
+		return nil
+	}
+	return &requestBudget{left: int64(n)}
+}
+
+// take takes one request from the budget. It returns false if the budget is spent.
+func (b *requestBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return atomic.AddInt64(&b.left, -1) >= 0
+}
+
+// spamAll spams all targets at once, either with fixed arrival rate or with virtual users, and waits until all of them finish.
+func spamAll(ctx context.Context, targets []*pingTarget, limits spamLimits, observe func(result)) {
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *pingTarget) {
+			defer wg.Done()
+			if *t.VirtualUsers > 0 {
+				runVirtualUsers(ctx, t, limits, observe)
+				return
+			}
+			spamPings(ctx, t, limits, observe)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// spamPings sends configured number of pings every second until context is canceled or given limits are reached.
+// It waits for all pings to finish before returning.
+func spamPings(ctx context.Context, t *pingTarget, limits spamLimits, observe func(result)) {
+	var (
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	defer wg.Wait()
+
+	if *t.PingsPerSecond <= 0 {
+		// Target is used only by journeys.
+		return
+	}
+	for {
+		if limits.duration > 0 && time.Since(start) >= limits.duration {
+			return
+		}
+
+		for i := 0; i < *t.PingsPerSecond; i++ {
+			if !limits.requests.take() {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if r, ok := t.ping(ctx); ok {
+					t.latencies.observe(r)
+					observe(r)
+				}
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// spamAtRate calls f in a new goroutine perSecond times a second until context is canceled or given limits are reached.
+// It waits for all calls to finish before returning.
+func spamAtRate(ctx context.Context, perSecond float64, limits spamLimits, f func()) {
+	var (
+		wg    sync.WaitGroup
+		start = time.Now()
+		t     = time.NewTicker(time.Duration(float64(time.Second) / perSecond))
+	)
+	defer t.Stop()
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if limits.duration > 0 && time.Since(start) >= limits.duration {
+			return
+		}
+		if !limits.requests.take() {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+}
+
+// newRequest creates request from randomly chosen template or plain GET to the endpoint if there are no templates.
+func (t *pingTarget) newRequest(ctx context.Context) (*http.Request, error) {
+	if tmpl := t.requests.next(); tmpl != nil {
+		return tmpl.newRequest(ctx, t.Endpoint, nil)
+	}
+	return http.NewRequestWithContext(ctx, http.MethodGet, t.Endpoint, nil)
+}
+
+// ping sends single ping to the target. It returns false if request was not sent at all.
+func (t *pingTarget) ping(ctx context.Context) (result, bool) {
+	return t.send(ctx, t.client, t.newRequest)
+}
+
+// maxBodySize is the maximum size of the response body kept in result, the rest is discarded.
+const maxBodySize = 1 << 20
+
+// send sends request created by newRequest with the given client within target timeout. It returns false if request
+// was not sent at all.
+func (t *pingTarget) send(ctx context.Context, client *http.Client, newRequest func(context.Context) (*http.Request, error)) (result, bool) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout())
+	defer cancel()
+
+	r, err := newRequest(ctx)
+	if err != nil {
+		fmt.Println("Failed to create request:", err)
+		return result{}, false
+	}
+
+	res := result{target: t.Name, start: time.Now()}
+	resp, err := client.Do(r)
+	if err != nil {
+		res.latency = time.Since(res.start)
+		res.code, res.reason = exthttp.CodeAndReason(nil, err)
+		fmt.Println("Failed to send request:", res.reason, err)
+		return res, true
+	}
+	if resp.Body != nil {
+		res.body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+		if err != nil {
+			fmt.Println("Failed to read response:", err)
+		}
+		// Release resources.
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	res.latency = time.Since(res.start)
+	res.header = resp.Header
+	res.code = strconv.Itoa(resp.StatusCode)
+	res.version = resp.Header.Get("X-App-Version")
+	return res, true
+}
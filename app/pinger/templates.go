@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// requestTemplate describes the shape of request sent to the target. All string fields are Go templates
+// that can use generator functions, see templateFuncs.
+type requestTemplate struct {
+	Name string `yaml:"name"`
+	// Weight decides how often this template is chosen relatively to others. Default is 1.
+	Weight int    `yaml:"weight"`
+	Method string `yaml:"method"`
+	// URL overrides target endpoint.
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Query   map[string]string `yaml:"query"`
+	Body    string            `yaml:"body"`
+
+	url     *template.Template
+	headers map[string]*template.Template
+	query   map[string]*template.Template
+	body    *template.Template
+}
+
+// templateFuncs generate values for request templates, e.g {{ randomID }}, {{ int 1 100 }} or {{ pick "a" "b" }}.
+var templateFuncs = template.FuncMap{
+	"randomID": func() string {
+		return fmt.Sprintf("%016x", rand.Uint64())
+	},
+	"int": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		return min + rand.Intn(max-min+1)
+	},
+	"float": func(min, max float64) float64 {
+		return min + rand.Float64()*(max-min)
+	},
+	"pick": func(values ...string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[rand.Intn(len(values))]
+	},
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse template %v", name)
+	}
+	return t, nil
+}
+
+func execTemplate(t *template.Template, data interface{}) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", errors.Wrapf(err, "execute template %v", t.Name())
+	}
+	return b.String(), nil
+}
+
+// compile parses all templates, so errors are reported at start and not on every request.
+func (r *requestTemplate) compile() (err error) {
+	if r.Weight == 0 {
+		r.Weight = 1
+	}
+	if r.Weight < 0 {
+		return errors.Errorf("template %q: weight can't be negative", r.Name)
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+
+	if r.URL != "" {
+		if r.url, err = parseTemplate("url", r.URL); err != nil {
+			return err
+		}
+	}
+	if r.Body != "" {
+		if r.body, err = parseTemplate("body", r.Body); err != nil {
+			return err
+		}
+	}
+	r.headers = map[string]*template.Template{}
+	for k, v := range r.Headers {
+		if r.headers[k], err = parseTemplate("header "+k, v); err != nil {
+			return err
+		}
+	}
+	r.query = map[string]*template.Template{}
+	for k, v := range r.Query {
+		if r.query[k], err = parseTemplate("query "+k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRequest generates new request from the template. Endpoint is used if template does not specify URL.
+// Data is available in templates, e.g values extracted in previous journey steps as {{ .token }}.
+func (r *requestTemplate) newRequest(ctx context.Context, endpoint string, data interface{}) (*http.Request, error) {
+	rawURL := endpoint
+	if r.url != nil {
+		v, err := execTemplate(r.url, data)
+		if err != nil {
+			return nil, err
+		}
+		rawURL = v
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse URL %v", rawURL)
+	}
+	if len(r.query) > 0 {
+		q := u.Query()
+		for k, t := range r.query {
+			v, err := execTemplate(t, data)
+			if err != nil {
+				return nil, err
+			}
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	var body io.Reader
+	if r.body != nil {
+		v, err := execTemplate(r.body, data)
+		if err != nil {
+			return nil, err
+		}
+		// bytes.Reader allows http package to replay the body on retries.
+		body = bytes.NewReader([]byte(v))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, t := range r.headers {
+		v, err := execTemplate(t, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// requestMix chooses request templates randomly according to their weights.
+type requestMix struct {
+	templates []*requestTemplate
+	// cumulative[i] is the sum of weights of templates up to and including i.
+	cumulative []int
+}
+
+func newRequestMix(templates []*requestTemplate) (*requestMix, error) {
+	m := &requestMix{}
+	sum := 0
+	for _, t := range templates {
+		if err := t.compile(); err != nil {
+			return nil, err
+		}
+		sum += t.Weight
+		m.templates = append(m.templates, t)
+		m.cumulative = append(m.cumulative, sum)
+	}
+	return m, nil
+}
+
+// next returns randomly chosen template or nil if there are no templates.
+func (m *requestMix) next() *requestTemplate {
+	if len(m.templates) == 0 || m.cumulative[len(m.cumulative)-1] == 0 {
+		return nil
+	}
+
+	n := rand.Intn(m.cumulative[len(m.cumulative)-1])
+	for i, c := range m.cumulative {
+		if n < c {
+			return m.templates[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	for _, tcase := range []struct {
+		text     string
+		expMatch *regexp.Regexp
+	}{
+		{text: `{{ randomID }}`, expMatch: regexp.MustCompile(`^[0-9a-f]{16}$`)},
+		{text: `{{ int 3 5 }}`, expMatch: regexp.MustCompile(`^[345]$`)},
+		{text: `{{ int 7 7 }}`, expMatch: regexp.MustCompile(`^7$`)},
+		{text: `{{ int 7 1 }}`, expMatch: regexp.MustCompile(`^7$`)},
+		{text: `{{ float 1.5 1.5 }}`, expMatch: regexp.MustCompile(`^1\.5$`)},
+		{text: `{{ float 1 2 }}`, expMatch: regexp.MustCompile(`^1(\.\d+)?$`)},
+		{text: `{{ pick "a" "b" }}`, expMatch: regexp.MustCompile(`^[ab]$`)},
+		{text: `{{ pick }}`, expMatch: regexp.MustCompile(`^$`)},
+	} {
+		t.Run(tcase.text, func(t *testing.T) {
+			tmpl, err := parseTemplate("test", tcase.text)
+			testutil.Ok(t, err)
+
+			for i := 0; i < 100; i++ {
+				v, err := execTemplate(tmpl, nil)
+				testutil.Ok(t, err)
+				testutil.Assert(t, tcase.expMatch.MatchString(v), "%q does not match %v", v, tcase.expMatch)
+			}
+		})
+	}
+}
+
+func TestRequestTemplate_NewRequest(t *testing.T) {
+	tmpl := &requestTemplate{
+		Method:  "POST",
+		Query:   map[string]string{"id": "{{ .id }}"},
+		Headers: map[string]string{"X-Token": "{{ .token }}"},
+		Body:    `{"n": {{ int 1 1 }}}`,
+	}
+	testutil.Ok(t, tmpl.compile())
+
+	req, err := tmpl.newRequest(context.Background(), "http://app/ping", map[string]string{"id": "a b", "token": "secret"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "POST", req.Method)
+	testutil.Equals(t, "http://app/ping?id=a+b", req.URL.String())
+	testutil.Equals(t, "secret", req.Header.Get("X-Token"))
+	b, err := ioutil.ReadAll(req.Body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"n": 1}`, string(b))
+	testutil.Assert(t, req.GetBody != nil, "body should be replayable")
+}
+
+func TestRequestMix(t *testing.T) {
+	t.Run("no templates", func(t *testing.T) {
+		m, err := newRequestMix(nil)
+		testutil.Ok(t, err)
+		testutil.Assert(t, m.next() == nil, "expected no template")
+	})
+	t.Run("negative weight", func(t *testing.T) {
+		_, err := newRequestMix([]*requestTemplate{{Name: "a", Weight: -1}})
+		testutil.NotOk(t, err)
+	})
+	t.Run("invalid template", func(t *testing.T) {
+		_, err := newRequestMix([]*requestTemplate{{Name: "a", Body: "{{ unknown }}"}})
+		testutil.NotOk(t, err)
+	})
+	t.Run("weights", func(t *testing.T) {
+		a, b, c := &requestTemplate{Name: "a"}, &requestTemplate{Name: "b", Weight: 3}, &requestTemplate{Name: "c", Weight: 6}
+		m, err := newRequestMix([]*requestTemplate{a, b, c})
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, a.Weight)
+		testutil.Equals(t, "GET", a.Method)
+		testutil.Equals(t, []int{1, 4, 10}, m.cumulative)
+
+		const n = 10000
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			counts[m.next().Name]++
+		}
+		for name, exp := range map[string]float64{"a": 0.1, "b": 0.3, "c": 0.6} {
+			got := float64(counts[name]) / n
+			testutil.Assert(t, got > exp-0.03 && got < exp+0.03, "template %v chosen %v of times, expected %v", name, got, exp)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Load models used as "model" label of pinger_load_model metric.
+const (
+	// openLoadModel sends requests with fixed arrival rate, no matter how long responses take.
+	openLoadModel = "open"
+	// closedLoadModel has fixed number of virtual users, each waiting for the response before sending the next request.
+	closedLoadModel = "closed"
+)
+
+// newActiveUsersGauge registers metrics describing load model of the target and returns gauge tracking
+// currently active virtual users.
+func newActiveUsersGauge(reg prometheus.Registerer, t targetConfig) prometheus.Gauge {
+	model := openLoadModel
+	if *t.VirtualUsers > 0 {
+		model = closedLoadModel
+	}
+	promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name:        "pinger_load_model",
+		Help:        "Load model used for the target, always 1. Join it on target to compare open and closed loop throughput.",
+		ConstLabels: prometheus.Labels{"target": t.Name, "model": model},
+	}).Set(1)
+
+	return promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name:        "pinger_virtual_users_active",
+		Help:        "Number of virtual users currently running in closed loop model.",
+		ConstLabels: prometheus.Labels{"target": t.Name},
+	})
+}
+
+// runVirtualUsers runs configured number of virtual users until context is canceled or given limits are reached.
+// Each user sends a ping, waits for the response, sleeps think time and repeats, so throughput drops when latency
+// rises. It waits for all users to finish before returning.
+func runVirtualUsers(ctx context.Context, t *pingTarget, limits spamLimits, observe func(result)) {
+	var (
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	defer wg.Wait()
+
+	for i := 0; i < *t.VirtualUsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			t.activeUsers.Inc()
+			defer t.activeUsers.Dec()
+
+			// Spread users over the think time, so they don't send requests in waves.
+			if !sleep(ctx, time.Duration(rand.Int63n(int64(t.ThinkTime)+1))) {
+				return
+			}
+			for {
+				if limits.duration > 0 && time.Since(start) >= limits.duration {
+					return
+				}
+				if !limits.requests.take() {
+					return
+				}
+
+				if r, ok := t.ping(ctx); ok {
+					t.latencies.observe(r)
+					observe(r)
+				}
+				if !sleep(ctx, time.Duration(t.ThinkTime)) {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// sleep waits for the given duration. It returns false if context was canceled in the meantime.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func TestRunVirtualUsers(t *testing.T) {
+	for _, tcase := range []struct {
+		name      string
+		users     int
+		thinkTime time.Duration
+		limits    spamLimits
+
+		expRequests int
+	}{
+		{name: "requests limit is shared by users", users: 3, limits: spamLimits{requests: newRequestBudget(10)}, expRequests: 10},
+		{name: "single user", users: 1, limits: spamLimits{requests: newRequestBudget(4)}, expRequests: 4},
+		{name: "more users than requests", users: 5, limits: spamLimits{requests: newRequestBudget(2)}, expRequests: 2},
+		{name: "think time slows users down", users: 2, thinkTime: 100 * time.Millisecond, limits: spamLimits{duration: 250 * time.Millisecond}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var inFlight, maxInFlight int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&inFlight, 1)
+				defer atomic.AddInt64(&inFlight, -1)
+				for {
+					m := atomic.LoadInt64(&maxInFlight)
+					if n <= m || atomic.CompareAndSwapInt64(&maxInFlight, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+			}))
+			defer srv.Close()
+
+			reg := prometheus.NewRegistry()
+			users := tcase.users
+			target := &pingTarget{
+				targetConfig: targetConfig{
+					Name:         "app",
+					Endpoint:     srv.URL,
+					VirtualUsers: &users,
+					ThinkTime:    model.Duration(tcase.thinkTime),
+					Timeout:      model.Duration(5 * time.Second),
+				},
+				client:    srv.Client(),
+				requests:  &requestMix{},
+				latencies: newLatencyRecorder(reg, "app", time.Minute, nil),
+			}
+			target.activeUsers = newActiveUsersGauge(reg, target.targetConfig)
+
+			var (
+				mu       sync.Mutex
+				requests int
+				codes    = map[string]int{}
+			)
+			runVirtualUsers(context.Background(), target, tcase.limits, func(r result) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				codes[r.code]++
+			})
+			testutil.Equals(t, map[string]int{"200": requests}, codes)
+
+			if tcase.expRequests > 0 {
+				testutil.Equals(t, tcase.expRequests, requests)
+			} else {
+				// Each user waits for the response and up to think time before the first and between next pings.
+				testutil.Assert(t, requests >= tcase.users && requests <= 3*tcase.users, "unexpected number of requests %v", requests)
+			}
+			// Closed loop never has more requests in flight than users.
+			testutil.Assert(t, atomic.LoadInt64(&maxInFlight) <= int64(tcase.users), "max in flight %v is above users %v", maxInFlight, tcase.users)
+			testutil.Equals(t, 0.0, gaugeValue(t, reg, "pinger_virtual_users_active"))
+			testutil.Equals(t, 1.0, gaugeValue(t, reg, "pinger_load_model"))
+		})
+	}
+}
+
+func TestRunVirtualUsers_StopsOnCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	users := 2
+	target := &pingTarget{
+		targetConfig: targetConfig{Name: "app", Endpoint: srv.URL, VirtualUsers: &users, ThinkTime: model.Duration(time.Hour), Timeout: model.Duration(5 * time.Second)},
+		client:       srv.Client(),
+		requests:     &requestMix{},
+		latencies:    newLatencyRecorder(reg, "app", time.Minute, nil),
+	}
+	target.activeUsers = newActiveUsersGauge(reg, target.targetConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runVirtualUsers(ctx, target, spamLimits{}, func(result) {})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	testutil.Equals(t, 2.0, gaugeValue(t, reg, "pinger_virtual_users_active"))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("virtual users did not stop after cancel")
+	}
+	testutil.Equals(t, 0.0, gaugeValue(t, reg, "pinger_virtual_users_active"))
+}
+
+// gaugeValue returns value of the only series of the gauge.
+func gaugeValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			testutil.Equals(t, 1, len(mf.GetMetric()))
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("gauge %v not found", name)
+	return 0
+}
@@ -2,16 +2,63 @@ package tracing
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/trace"
 )
 
+// DoInSpan runs f in the new span. If context carries Timings (see WithTimings), duration of f is recorded there
+// under the span name.
 func DoInSpan(ctx context.Context, spanName string, f func(context.Context, Span), opts ...SpanOption) {
+	start := time.Now()
 	sctx, span := Start(ctx, spanName, opts...)
 	f(sctx, span)
 	span.End()
+
+	if t := timingsFromContext(ctx); t != nil {
+		t.add(spanName, time.Since(start))
+	}
 }
 
 func Start(ctx context.Context, spanName string, opts ...SpanOption) (context.Context, Span) {
 	return trace.SpanFromContext(ctx).Tracer().Start(ctx, spanName, opts...)
 }
+
+// Timing is the duration of the named phase.
+type Timing struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Timings collects durations of phases run with DoInSpan, e.g to report them in Server-Timing response header.
+type Timings struct {
+	mu      sync.Mutex
+	timings []Timing
+}
+
+type timingsKey struct{}
+
+// WithTimings returns context that makes DoInSpan record phase durations into returned Timings.
+func WithTimings(ctx context.Context) (context.Context, *Timings) {
+	t := &Timings{}
+	return context.WithValue(ctx, timingsKey{}, t), t
+}
+
+func timingsFromContext(ctx context.Context) *Timings {
+	t, _ := ctx.Value(timingsKey{}).(*Timings)
+	return t
+}
+
+func (t *Timings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timings = append(t.timings, Timing{Name: name, Duration: d})
+}
+
+// All returns phases finished so far, in order of finishing.
+func (t *Timings) All() []Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Timing(nil), t.timings...)
+}
@@ -37,6 +37,9 @@ func getPinger(endpoint string, name string) appsv1.Deployment {
 							"-endpoint=" + endpoint,
 							fmt.Sprintf("-listen-address=:%v", httpPort),
 							"-pings-per-second=10",
+							// Rotate connections, so pings are spread across stable and canary pods according to Rollout weights.
+							"-connections.mode=max-age",
+							"-connections.max-age=10s",
 						},
 						Ports: []corev1.ContainerPort{{Name: "m-http", ContainerPort: httpPort}},
 					}},
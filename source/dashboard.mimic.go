@@ -105,7 +105,7 @@ const demoDashboardJSON = `{
       "targets": [
         {
           "exemplar": true,
-          "expr": " 100* sum(rate(\n            http_client_requests_total{target=\"ping\",code!~\"5.*\"}[1m]\n          )) /\n          sum(rate(\n            http_client_requests_total{target=\"ping\"}[1m]\n          ))",
+          "expr": " 100* sum(rate(\n            http_client_requests_total{target=\"ping\",code!~\"5.*|error\"}[1m]\n          )) /\n          sum(rate(\n            http_client_requests_total{target=\"ping\"}[1m]\n          ))",
           "hide": false,
           "interval": "",
           "legendFormat": "",
@@ -257,10 +257,10 @@ const demoDashboardJSON = `{
       "targets": [
         {
           "exemplar": true,
-          "expr": "sum by(code) (rate(http_client_requests_total{target=\"ping\"}[1m]))",
+          "expr": "sum by(code, reason) (rate(http_client_requests_total{target=\"ping\"}[1m]))",
           "hide": false,
           "interval": "",
-          "legendFormat": "",
+          "legendFormat": "{{code}} {{reason}}",
           "refId": "B"
         }
       ],
@@ -268,7 +268,7 @@ const demoDashboardJSON = `{
       "timeFrom": null,
       "timeRegions": [],
       "timeShift": null,
-      "title": "Client requests per second by code",
+      "title": "Client requests per second by code and reason",
       "tooltip": {
         "shared": true,
         "sort": 0,
@@ -500,7 +500,7 @@ const demoDashboardJSON = `{
       "steppedLine": false,
       "targets": [
         {
-          "exemplar": false,
+          "exemplar": true,
           "expr": "sum(sum by(code, pod) (rate(http_requests_total{handler=\"/ping\", code=~\"5..\", pod=~\"app.*\"}[1m])) * on(pod) group_left(version) app_build_info) by(code, version)",
           "hide": false,
           "interval": "",
@@ -851,6 +851,174 @@ const demoDashboardJSON = `{
         "align": false,
         "alignLevel": null
       }
+    },
+    {
+      "collapsed": false,
+      "datasource": null,
+      "gridPos": {
+        "h": 1,
+        "w": 24,
+        "x": 0,
+        "y": 27
+      },
+      "id": 22,
+      "panels": [],
+      "title": "Load Model",
+      "type": "row"
+    },
+    {
+      "datasource": null,
+      "fieldConfig": {
+        "defaults": {
+          "color": {
+            "mode": "palette-classic"
+          },
+          "custom": {
+            "axisLabel": "",
+            "axisPlacement": "auto",
+            "barAlignment": 0,
+            "drawStyle": "line",
+            "fillOpacity": 10,
+            "gradientMode": "none",
+            "hideFrom": {
+              "graph": false,
+              "legend": false,
+              "tooltip": false
+            },
+            "lineInterpolation": "linear",
+            "lineWidth": 1,
+            "pointSize": 5,
+            "scaleDistribution": {
+              "type": "linear"
+            },
+            "showPoints": "never",
+            "spanNulls": true
+          },
+          "mappings": [],
+          "thresholds": {
+            "mode": "absolute",
+            "steps": [
+              {
+                "color": "green",
+                "value": null
+              },
+              {
+                "color": "red",
+                "value": 80
+              }
+            ]
+          },
+          "unit": "reqps"
+        },
+        "overrides": []
+      },
+      "gridPos": {
+        "h": 8,
+        "w": 14,
+        "x": 0,
+        "y": 28
+      },
+      "id": 23,
+      "options": {
+        "graph": {},
+        "legend": {
+          "calcs": [],
+          "displayMode": "list",
+          "placement": "bottom"
+        },
+        "tooltipOptions": {
+          "mode": "single"
+        }
+      },
+      "pluginVersion": "7.5.2",
+      "targets": [
+        {
+          "exemplar": true,
+          "expr": "sum by (model) (\n            rate(http_client_requests_total[1m])\n            * on (pod, target) group_left(model) pinger_load_model\n          )",
+          "interval": "",
+          "legendFormat": "{{model}} loop",
+          "refId": "A"
+        }
+      ],
+      "title": "Client throughput by load model (open vs closed loop)",
+      "type": "timeseries"
+    },
+    {
+      "datasource": null,
+      "fieldConfig": {
+        "defaults": {
+          "color": {
+            "mode": "palette-classic"
+          },
+          "custom": {
+            "axisLabel": "",
+            "axisPlacement": "auto",
+            "barAlignment": 0,
+            "drawStyle": "line",
+            "fillOpacity": 10,
+            "gradientMode": "none",
+            "hideFrom": {
+              "graph": false,
+              "legend": false,
+              "tooltip": false
+            },
+            "lineInterpolation": "linear",
+            "lineWidth": 1,
+            "pointSize": 5,
+            "scaleDistribution": {
+              "type": "linear"
+            },
+            "showPoints": "never",
+            "spanNulls": true
+          },
+          "mappings": [],
+          "thresholds": {
+            "mode": "absolute",
+            "steps": [
+              {
+                "color": "green",
+                "value": null
+              },
+              {
+                "color": "red",
+                "value": 80
+              }
+            ]
+          },
+          "unit": "short"
+        },
+        "overrides": []
+      },
+      "gridPos": {
+        "h": 8,
+        "w": 10,
+        "x": 14,
+        "y": 28
+      },
+      "id": 24,
+      "options": {
+        "graph": {},
+        "legend": {
+          "calcs": [],
+          "displayMode": "list",
+          "placement": "bottom"
+        },
+        "tooltipOptions": {
+          "mode": "single"
+        }
+      },
+      "pluginVersion": "7.5.2",
+      "targets": [
+        {
+          "exemplar": true,
+          "expr": "sum by (target) (pinger_virtual_users_active)",
+          "interval": "",
+          "legendFormat": "{{target}}",
+          "refId": "A"
+        }
+      ],
+      "title": "Active virtual users",
+      "type": "timeseries"
     }
   ],
   "refresh": "10s",